@@ -0,0 +1,57 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/skelterjohn/flargo/config"
+	"github.com/skelterjohn/flargo/workflow"
+)
+
+// approve completes a wait execution on behalf of the current gcloud account.
+func approve(ctx context.Context, e *env, workflowID, name, comment string) error {
+	state, _, err := findExecution(ctx, e, workflowID, name)
+	if err != nil {
+		return err
+	}
+	ex := state.Executions[name]
+	if ex.Type != config.TypeWait {
+		return fmt.Errorf("%q is not a wait execution", name)
+	}
+	if ex.Status.Done() {
+		return fmt.Errorf("%q has already completed", name)
+	}
+	if !state.Ready(name) {
+		return fmt.Errorf("%q is still waiting for its dependencies", name)
+	}
+
+	approval := &workflow.Approval{
+		By:      e.account,
+		At:      time.Now().UTC().Format(time.RFC3339),
+		Comment: comment,
+	}
+	if err := workflow.Publish(ctx, e.pubsub, workflow.TopicName(e.projectID, workflowID), workflow.Message{
+		Completed: name,
+		Status:    workflow.StatusSucceeded,
+		Approval:  approval,
+	}); err != nil {
+		return fmt.Errorf("could not publish approval: %v", err)
+	}
+	log.Printf("Approved %q as %s", name, approval.By)
+	return nil
+}
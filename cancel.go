@@ -0,0 +1,135 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+	v1pubsub "google.golang.org/api/pubsub/v1"
+
+	"github.com/skelterjohn/flargo/executions"
+	"github.com/skelterjohn/flargo/workflow"
+)
+
+// cancel stops the workflow: it cancels coord and every build still going,
+// records that the workflow was cancelled, and deletes the workflow's topic
+// and its subscriptions.
+func cancel(ctx context.Context, e *env, workflowID string) error {
+	state, err := loadState(ctx, e, workflowID)
+	if err != nil {
+		return err
+	}
+	// Cancelling would rewrite how the workflow ended.
+	if state.Over() {
+		return fmt.Errorf("workflow %s has already %s", workflowID, state.Result)
+	}
+
+	// Coord goes first, so that it does not start anything new, or retry
+	// what is cancelled after it.
+	status, err := e.executions.FetchBuildStatus(ctx, workflowID)
+	if err != nil {
+		return fmt.Errorf("could not get status of coord build %s: %v", workflowID, err)
+	}
+	if status != "SUCCESS" && !executions.BuildFailed(status) {
+		if err := e.executions.CancelBuild(ctx, workflowID); err != nil {
+			return fmt.Errorf("could not cancel coord build %s: %v", workflowID, err)
+		}
+		log.Printf("Cancelled coord build %s", workflowID)
+	}
+	var names []string
+	for name := range state.Executions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := cancelExecution(ctx, e, state.Executions[name]); err != nil {
+			return err
+		}
+	}
+
+	topic := workflow.TopicName(e.projectID, workflowID)
+	if _, err := e.pubsub.Projects.Topics.Get(topic).Context(ctx).Do(); err != nil {
+		if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == 404 {
+			log.Printf("Workflow %s has no topic left", workflowID)
+			return recordCancellation(ctx, e, workflowID, "")
+		}
+		return fmt.Errorf("could not get topic %q: %v", topic, err)
+	}
+
+	// Anyone waiting on the workflow hears about it before their
+	// subscription goes.
+	data, err := workflow.EncodeMessage(cancellation)
+	if err != nil {
+		return fmt.Errorf("could not encode message: %v", err)
+	}
+	resp, err := e.pubsub.Projects.Topics.Publish(topic, &v1pubsub.PublishRequest{
+		Messages: []*v1pubsub.PubsubMessage{{
+			Data: data,
+		}},
+	}).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("could not publish cancellation: %v", err)
+	}
+	var messageID string
+	if len(resp.MessageIds) != 0 {
+		messageID = resp.MessageIds[0]
+	}
+	if err := recordCancellation(ctx, e, workflowID, messageID); err != nil {
+		return err
+	}
+
+	var subscriptions []string
+	if err := e.pubsub.Projects.Topics.Subscriptions.List(topic).Pages(ctx, func(resp *v1pubsub.ListTopicSubscriptionsResponse) error {
+		subscriptions = append(subscriptions, resp.Subscriptions...)
+		return nil
+	}); err != nil {
+		return fmt.Errorf("could not list subscriptions of %q: %v", topic, err)
+	}
+	for _, sname := range subscriptions {
+		if _, err := e.pubsub.Projects.Subscriptions.Delete(sname).Context(ctx).Do(); err != nil {
+			return fmt.Errorf("could not delete subscription %q: %v", sname, err)
+		}
+		log.Printf("Deleted subscription %q", sname)
+	}
+	if _, err := e.pubsub.Projects.Topics.Delete(topic).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("could not delete topic %q: %v", topic, err)
+	}
+	log.Printf("Deleted topic %q", topic)
+	return nil
+}
+
+// cancellation is the message that says the workflow was cancelled.
+var cancellation = workflow.Message{
+	Result: workflow.StatusFailed,
+	Reason: workflow.ReasonCancelled,
+}
+
+// recordCancellation adds the cancellation to the event log, since coord is no
+// longer around to do it. If coord does record it, applying it twice does
+// nothing more.
+func recordCancellation(ctx context.Context, e *env, workflowID, messageID string) error {
+	if messageID == "" {
+		messageID = fmt.Sprintf("cancel-%d", time.Now().UnixNano())
+	}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	if err := workflow.RecordEvent(ctx, e.storage, e.projectID, workflowID, messageID, now, cancellation); err != nil {
+		return fmt.Errorf("could not record cancellation: %v", err)
+	}
+	log.Printf("Cancelled workflow %s", workflowID)
+	return nil
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"log"
+	"os"
+
+	"cloud.google.com/go/compute/metadata"
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+	v1pubsub "google.golang.org/api/pubsub/v1"
+
+	"github.com/skelterjohn/flargo/workflow"
+)
+
+/*
+The complete program is the last step of every execution's build. It uploads
+whatever the execution left in /workflow_artifacts/out, and announces on the
+workflow topic that the execution has completed. If the execution left a config
+fragment in out/flargo.wf, its executions go along with the announcement, to be
+added to the workflow.
+*/
+
+func init() {
+	// Because the metadata package can't figure this out itself.
+	os.Setenv("GCE_METADATA_HOST", "metadata.google.internal")
+}
+
+func main() {
+	ctx := context.Background()
+
+	c, err := workflow.ParseCompleter(os.Args[1:])
+	if err != nil {
+		log.Printf("%v", err)
+		log.Fatalf("Usage: %s", workflow.CompleteUsage)
+	}
+
+	c.ProjectID, err = metadata.ProjectID()
+	if err != nil {
+		log.Fatalf("Could not get project ID")
+	}
+
+	client := oauth2.NewClient(ctx, google.ComputeTokenSource(""))
+
+	c.PubSub, err = v1pubsub.New(client)
+	if err != nil {
+		log.Fatalf("Could not create pubsub client: %v", err)
+	}
+
+	c.Storage, err = storage.NewClient(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		log.Fatalf("Could not create storage client: %v", err)
+	}
+
+	c.Artifacts = "/workflow_artifacts"
+	if err := c.Run(ctx); err != nil {
+		log.Fatal(err)
+	}
+}
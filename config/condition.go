@@ -0,0 +1,110 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// OutcomeSuccess holds if a dependency completed or was skipped.
+	OutcomeSuccess = "success"
+	// OutcomeFailure holds if a dependency failed, or was blocked by a
+	// failure.
+	OutcomeFailure = "failure"
+)
+
+// A Condition decides whether an execution runs at all. It either checks the
+// outcome of one of the execution's dependencies,
+//
+//	exec: notify(test) if failure(test) notify.yaml
+//
+// or compares a param to a value.
+//
+//	exec: deploy_prod(test) if param.env == "prod" deploy.yaml
+//
+// An execution whose condition does not hold is skipped.
+type Condition struct {
+	// Outcome is OutcomeSuccess or OutcomeFailure, and Execution is the
+	// dependency whose outcome is checked.
+	Outcome   string `json:",omitempty"`
+	Execution string `json:",omitempty"`
+	// Otherwise, Param is compared to Value with Op, which is "==" or "!=".
+	Param string `json:",omitempty"`
+	Op    string `json:",omitempty"`
+	Value string `json:",omitempty"`
+}
+
+func (c Condition) String() string {
+	if c.Outcome != "" {
+		return fmt.Sprintf("%s(%s)", c.Outcome, c.Execution)
+	}
+	return fmt.Sprintf("param.%s %s %q", c.Param, c.Op, c.Value)
+}
+
+// Compare checks a param condition against the param's value.
+func (c Condition) Compare(value string) bool {
+	if c.Op == "!=" {
+		return value != c.Value
+	}
+	return value == c.Value
+}
+
+// parseCondition reads what follows 'if', and returns the rest of the line.
+func parseCondition(s string) (*Condition, string, error) {
+	s = strings.TrimSpace(s)
+	for _, outcome := range []string{OutcomeSuccess, OutcomeFailure} {
+		if !strings.HasPrefix(s, outcome+"(") {
+			continue
+		}
+		parenStop := strings.Index(s, ")")
+		if parenStop == -1 {
+			return nil, "", fmt.Errorf("expected '%s( execution )'", outcome)
+		}
+		c := &Condition{
+			Outcome:   outcome,
+			Execution: strings.TrimSpace(s[len(outcome)+1 : parenStop]),
+		}
+		if c.Execution == "" {
+			return nil, "", fmt.Errorf("expected '%s( execution )'", outcome)
+		}
+		return c, strings.TrimSpace(s[parenStop+1:]), nil
+	}
+
+	if !strings.HasPrefix(s, "param.") {
+		return nil, "", fmt.Errorf(`expected 'success(...)', 'failure(...)' or 'param.name == "value"'`)
+	}
+	s = s[len("param."):]
+	opStart := strings.IndexAny(s, "=!")
+	if opStart == -1 || !strings.HasPrefix(s[opStart+1:], "=") {
+		return nil, "", fmt.Errorf("expected '==' or '!='")
+	}
+	c := &Condition{
+		Param: strings.TrimSpace(s[:opStart]),
+		Op:    s[opStart : opStart+2],
+	}
+	if !isToken(c.Param, false) {
+		return nil, "", fmt.Errorf("invalid param name %q", c.Param)
+	}
+	s = strings.TrimSpace(s[opStart+2:])
+	if !strings.HasPrefix(s, `"`) {
+		return nil, "", fmt.Errorf("expected a quoted value after %q", c.Op)
+	}
+	quoteStop := strings.Index(s[1:], `"`)
+	if quoteStop == -1 {
+		return nil, "", fmt.Errorf("unterminated value")
+	}
+	c.Value = s[1 : quoteStop+1]
+	return c, strings.TrimSpace(s[quoteStop+2:]), nil
+}
@@ -16,17 +16,51 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"os"
 	"strings"
+	"time"
+	"unicode"
 )
 
 /*
-type ':' name '(' name [ 'as' bar ] ')' file
+'param' ':' name [ '=' default ]
+type ':' name [ '[' key '=' value, ... ; ... ']' ] '(' name [ 'as' bar ] ')' [ 'if' condition ] [ 'retries=' n ] [ 'backoff=' duration ] [ 'timeout=' duration ] ( file | '{' build '}' | 'use' [ ns '.' ] template '(' key '=' value ... ')' )
+'template' ':' name '(' param [ '=' default ] ... ')' ( file | '{' build '}' )
+'import' '"' path '"' 'as' ns
 */
 
+// Types of executions. An exec is a cloudbuild build, and a wait is a gate that
+// completes when someone approves it.
+const (
+	TypeExec = "exec"
+	TypeWait = "wait"
+)
+
 type Config struct {
 	Executions []Execution
+	Parameters []Parameter `json:",omitempty"`
 	Path       string
+
+	// positions has, for each execution parsed, where it was in the file.
+	positions []executionPos
+	// templates and imports are only used while loading the config.
+	templates map[string]*template
+	imports   []importDecl
+}
+
+// A Pos is a place in a config file. Lines and columns count from 1.
+type Pos struct {
+	Line   int
+	Column int
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+type executionPos struct {
+	name   Pos
+	params []Pos
+	when   Pos
 }
 
 type Execution struct {
@@ -34,28 +68,159 @@ type Execution struct {
 	Name   string
 	Params []Param
 	Path   string
+	// Body is the build, if it was written in the config instead of in a
+	// file of its own.
+	Body string `json:",omitempty"`
+	// Template is the template the build came from, if any, and Args has
+	// the values it was given.
+	Template string            `json:",omitempty"`
+	Args     map[string]string `json:",omitempty"`
+	// Group is the name the execution was given in the config, if it is one
+	// of the combinations of a matrix, and Matrix has its values.
+	Group  string            `json:",omitempty"`
+	Matrix map[string]string `json:",omitempty"`
+	// When, if set, decides whether the execution runs once its dependencies
+	// have finished.
+	When *Condition `json:",omitempty"`
+	// Retries is how many times a failed build is retried automatically,
+	// after waiting Backoff the first time and twice as long each time after.
+	Retries int           `json:",omitempty"`
+	Backoff time.Duration `json:",omitempty"`
+	// Timeout, if set, is how long the execution may run once everything it
+	// depends on is done.
+	Timeout time.Duration `json:",omitempty"`
+
+	// use is the template the build is to come from, until it is resolved.
+	use *templateUse
 }
 
 type Param struct {
 	Name string
+	// Alias, if set, is where the dependency's artifacts appear instead of
+	// under its name.
+	Alias string
+}
+
+// LocalName is the name the dependency's artifacts appear under in the
+// execution, which is in/<LocalName>.
+func (p Param) LocalName() string {
+	if p.Alias != "" {
+		return p.Alias
+	}
+	return p.Name
 }
 
 func Load(path string) (*Config, error) {
-	fin, err := os.Open(path)
+	return LoadFrom(path, OpenFile)
+}
+
+// LoadFrom is like Load, but reads the config and what it imports with open.
+func LoadFrom(path string, open Opener) (*Config, error) {
+	cfg, err := read(path, open)
 	if err != nil {
-		return nil, fmt.Errorf("could not open %q: %v", path, err)
+		return nil, err
 	}
-	cfg, err := Parse(fin)
-	if err != nil {
+	cfg.Path = path
+	if err := cfg.resolve(path, open); err != nil {
+		return nil, fmt.Errorf("could not parse %q: %v", path, err)
+	}
+	if err := Validate(cfg); err != nil {
 		return nil, fmt.Errorf("could not parse %q: %v", path, err)
 	}
+	return cfg, nil
+}
 
-	cfg.Path = path
+func Parse(r io.Reader) (*Config, error) {
+	c, err := parse(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.resolve("", OpenFile); err != nil {
+		return nil, err
+	}
+	if err := Validate(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ParseFragment reads executions to be added to a running workflow. They may
+// depend on executions that are not in the fragment, so it is only checked
+// once it is added with Extend.
+func ParseFragment(r io.Reader) (*Config, error) {
+	c, err := parse(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.resolve("", OpenFile); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
 
+// LoadFragment is like ParseFragment, but reads the fragment from a file, so
+// that what it refers to is found relative to it.
+func LoadFragment(path string) (*Config, error) {
+	c, err := read(path, OpenFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.resolve(path, OpenFile); err != nil {
+		return nil, fmt.Errorf("could not parse %q: %v", path, err)
+	}
+	return c, nil
+}
+
+// read parses the config at path, without resolving it.
+func read(path string, open Opener) (*Config, error) {
+	fin, err := open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open %q: %v", path, err)
+	}
+	defer fin.Close()
+	cfg, err := parse(fin)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %q: %v", path, err)
+	}
 	return cfg, nil
 }
 
-func Parse(r io.Reader) (*Config, error) {
+// Extend adds the executions in a fragment to the config, each depending on
+// parent as well as on whatever it names itself. If the result would not be a
+// valid workflow, the config is left as it was.
+func (c *Config) Extend(fragment *Config, parent string) error {
+	if len(fragment.Parameters) != 0 {
+		return fmt.Errorf("fragment declares params, which can only be given when the workflow starts")
+	}
+	ext := Config{
+		Executions: append([]Execution(nil), c.Executions...),
+		Parameters: c.Parameters,
+		Path:       c.Path,
+		positions:  append([]executionPos(nil), c.positions...),
+	}
+	for _, e := range fragment.Executions {
+		e.Params = append([]Param(nil), e.Params...)
+		hasParent := false
+		for _, p := range e.Params {
+			hasParent = hasParent || p.Name == parent
+		}
+		if !hasParent {
+			e.Params = append([]Param{{Name: parent}}, e.Params...)
+		}
+		ext.Executions = append(ext.Executions, e)
+	}
+	// The fragment may depend on groups from the rest of the workflow.
+	if err := expandGroups(&ext); err != nil {
+		return err
+	}
+	if err := Validate(&ext); err != nil {
+		return err
+	}
+	c.Executions = ext.Executions
+	return nil
+}
+
+func parse(r io.Reader) (*Config, error) {
 	data, err := ioutil.ReadAll(r)
 	if err != nil {
 		return nil, err
@@ -65,60 +230,214 @@ func Parse(r io.Reader) (*Config, error) {
 
 	var c Config
 
-	for lineNumber, l := range lines {
+	for lineNumber := 0; lineNumber < len(lines); lineNumber++ {
+		l := lines[lineNumber]
+		line := lineNumber + 1
 		s := strings.TrimSpace(l)
 		if s == "" || s[0] == '#' {
 			continue
 		}
+		// Everything left to parse is a suffix of the trimmed line, so its
+		// column can be found from its length.
+		trimmed := strings.TrimRightFunc(l, unicode.IsSpace)
+		column := func(s string) int {
+			return len(trimmed) - len(s) + 1
+		}
+
+		if strings.HasPrefix(s, "import ") {
+			imp, err := parseImport(s)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			imp.line = line
+			c.imports = append(c.imports, imp)
+			continue
+		}
+
 		var e Execution
+		var epos executionPos
 		colonStop := strings.Index(s, ":")
 		if colonStop == -1 {
-			return nil, fmt.Errorf("line %d: expected '^<type> :'", lineNumber)
+			return nil, fmt.Errorf("line %d: expected '^<type> :'", line)
 		}
 		e.Type = strings.TrimSpace(s[:colonStop])
+		if e.Type == TypeParam {
+			p, err := parseParameter(s[colonStop+1:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			for _, q := range c.Parameters {
+				if SubstitutionKey(q.Name) == SubstitutionKey(p.Name) {
+					return nil, fmt.Errorf("line %d: repeated param %q", line, p.Name)
+				}
+			}
+			c.Parameters = append(c.Parameters, p)
+			continue
+		}
+		if e.Type == TypeTemplate {
+			t, err := parseTemplate(s[colonStop+1:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			if t.Path == "{" {
+				t.Path = ""
+				if t.Body, lineNumber, err = readBlock(lines, lineNumber); err != nil {
+					return nil, err
+				}
+			}
+			if c.templates == nil {
+				c.templates = map[string]*template{}
+			}
+			if _, ok := c.templates[t.Name]; ok {
+				return nil, fmt.Errorf("line %d: repeated template %q", line, t.Name)
+			}
+			c.templates[t.Name] = t
+			continue
+		}
+		if e.Type != TypeExec && e.Type != TypeWait {
+			return nil, fmt.Errorf("line %d: unknown type %q", line, e.Type)
+		}
 		s = strings.TrimSpace(s[colonStop+1:])
 		parenStop := strings.Index(s, "(")
 		if parenStop == -1 {
-			return nil, fmt.Errorf("line %d: expected 'name ('", lineNumber)
+			return nil, fmt.Errorf("line %d: expected 'name ('", line)
+		}
+		epos.name = Pos{line, column(s)}
+		name, dims, err := parseMatrix(strings.TrimSpace(s[:parenStop]))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", epos.name, err)
 		}
-		e.Name = strings.TrimSpace(s[:parenStop])
+		e.Name = name
 		s = strings.TrimSpace(s[parenStop+1:])
 
 		parenStop = strings.Index(s, ")")
 		if parenStop == -1 {
-			return nil, fmt.Errorf("line %d: expected '( param, param, ... )'", lineNumber)
+			return nil, fmt.Errorf("line %d: expected '( param, param, ... )'", line)
 		}
 		ps := s[:parenStop]
+		psColumn := column(s)
 		s = strings.TrimSpace(s[parenStop+1:])
 		paramTokens := strings.Split(ps, ",")
+		localNames := map[string]bool{}
+		offset := 0
 		for _, pt := range paramTokens {
 			if pt == "" {
 				break
 			}
+			ptPos := Pos{line, psColumn + offset + len(pt) - len(strings.TrimLeftFunc(pt, unicode.IsSpace))}
+			offset += len(pt) + 1
 			ptTokens := strings.Fields(pt)
 
-			var name string
-			name = ptTokens[0]
-			if len(ptTokens) != 1 {
-				return nil, fmt.Errorf("line %d: wrong number of tokens for param %q", lineNumber, pt)
+			var name, alias string
+			switch {
+			case len(ptTokens) == 1:
+				name = ptTokens[0]
+			case len(ptTokens) == 3 && ptTokens[1] == "as":
+				name, alias = ptTokens[0], ptTokens[2]
+			default:
+				return nil, fmt.Errorf("%s: wrong number of tokens for param %q", ptPos, pt)
 			}
-			e.Params = append(e.Params, Param{
-				Name: name,
-			})
+			p := Param{
+				Name:  name,
+				Alias: alias,
+			}
+			if localNames[p.LocalName()] {
+				return nil, fmt.Errorf("%s: repeated param name %q", ptPos, p.LocalName())
+			}
+			localNames[p.LocalName()] = true
+			e.Params = append(e.Params, p)
+			epos.params = append(epos.params, ptPos)
 		}
 
-		e.Path = s
+		// A condition, a retry policy and a timeout may come before the
+		// build, in any order.
+	annotations:
+		for {
+			switch {
+			case strings.HasPrefix(s, "if ") && e.When == nil:
+				epos.when = Pos{line, column(s)}
+				if e.When, s, err = parseCondition(s[len("if "):]); err != nil {
+					return nil, fmt.Errorf("%s: %v", epos.when, err)
+				}
+			case strings.HasPrefix(s, "retries="), strings.HasPrefix(s, "backoff="), strings.HasPrefix(s, "timeout="):
+				pos := Pos{line, column(s)}
+				field := strings.Fields(s)[0]
+				if err := parseAnnotation(&e, field); err != nil {
+					return nil, fmt.Errorf("%s: %v", pos, err)
+				}
+				s = strings.TrimSpace(s[len(field):])
+			default:
+				break annotations
+			}
+		}
 
-		c.Executions = append(c.Executions, e)
-	}
+		switch {
+		case s == "{":
+			if e.Body, lineNumber, err = readBlock(lines, lineNumber); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(s, "use "):
+			if e.Type != TypeExec {
+				return nil, fmt.Errorf("line %d: only exec executions can use a template", line)
+			}
+			if e.use, err = parseUse(s[len("use "):]); err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			e.use.line = line
+		default:
+			e.Path = s
+		}
 
-	names := map[string]bool{}
-	for _, e := range c.Executions {
-		if names[e.Name] {
-			return nil, fmt.Errorf("repeated name %q", e.Name)
+		members := []Execution{e}
+		if dims != nil {
+			members = expandMatrix(e, dims)
+		}
+		for _, m := range members {
+			c.Executions = append(c.Executions, m)
+			c.positions = append(c.positions, epos)
 		}
-		names[e.Name] = true
+	}
+
+	if err := expandGroups(&c); err != nil {
+		return nil, err
 	}
 
 	return &c, nil
 }
+
+// readBlock reads the lines after start, up to a line with just a closing
+// brace, and returns them along with the index of the closing line.
+func readBlock(lines []string, start int) (string, int, error) {
+	end := start + 1
+	for end < len(lines) && strings.TrimSpace(lines[end]) != "}" {
+		end++
+	}
+	if end == len(lines) {
+		return "", 0, fmt.Errorf("line %d: expected '}' to end the block", start+1)
+	}
+	return dedent(lines[start+1 : end]), end, nil
+}
+
+// dedent joins the lines of a block, without the indentation they all share.
+func dedent(lines []string) string {
+	indent := ""
+	first := true
+	for _, l := range lines {
+		if strings.TrimSpace(l) == "" {
+			continue
+		}
+		lead := l[:len(l)-len(strings.TrimLeftFunc(l, unicode.IsSpace))]
+		if first {
+			indent, first = lead, false
+			continue
+		}
+		for !strings.HasPrefix(lead, indent) {
+			indent = indent[:len(indent)-1]
+		}
+	}
+	var out []string
+	for _, l := range lines {
+		out = append(out, strings.TrimPrefix(l, indent))
+	}
+	return strings.Join(out, "\n") + "\n"
+}
@@ -14,9 +14,13 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestBasicParse(t *testing.T) {
@@ -116,3 +120,359 @@ exec: test_prod(deploy_to_prod, build_probes) test_prod.yaml
 		}
 	}
 }
+
+func TestUnknownType(t *testing.T) {
+	r := strings.NewReader(`
+exec: build() build.yaml
+run: test(build) test.yaml
+`)
+	if _, err := Parse(r); err == nil {
+		t.Error("expected an error for type \"run\"")
+	}
+}
+
+func TestAliasParse(t *testing.T) {
+	r := strings.NewReader(`
+exec: build() build.yaml
+exec: build_probes() probe.yaml
+exec: test_dev(build as service, build_probes as probes) test_dev.yaml
+`)
+	config, err := Parse(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Param{{
+		Name:  "build",
+		Alias: "service",
+	}, {
+		Name:  "build_probes",
+		Alias: "probes",
+	}}
+	if !reflect.DeepEqual(config.Executions[2].Params, expected) {
+		t.Errorf("got\n%+v\nwant:\n%+v\n", config.Executions[2].Params, expected)
+	}
+}
+
+func TestBadAliasParse(t *testing.T) {
+	for _, line := range []string{
+		"exec: test(build as) test.yaml",
+		"exec: test(build like service) test.yaml",
+		"exec: test(build as service, build_probes as service) test.yaml",
+		"exec: test(build, build_probes as build) test.yaml",
+	} {
+		if _, err := Parse(strings.NewReader(line)); err == nil {
+			t.Errorf("%q: expected an error", line)
+		}
+	}
+}
+
+func TestExtend(t *testing.T) {
+	c, err := Parse(strings.NewReader(`
+exec: build() build.yaml
+exec: discover(build) discover.yaml
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frag, err := ParseFragment(strings.NewReader(`
+exec: deploy_a(build as bin) deploy.yaml
+exec: deploy_b(discover) deploy.yaml
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Extend(frag, "discover"); err != nil {
+		t.Fatal(err)
+	}
+	want := []Execution{
+		{Type: TypeExec, Name: "deploy_a", Params: []Param{{Name: "discover"}, {Name: "build", Alias: "bin"}}, Path: "deploy.yaml"},
+		{Type: TypeExec, Name: "deploy_b", Params: []Param{{Name: "discover"}}, Path: "deploy.yaml"},
+	}
+	if got := c.Executions[2:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// Adding the same executions again would repeat their names.
+	frag, err = ParseFragment(strings.NewReader(`
+exec: deploy_a() deploy.yaml
+exec: later(nothing) later.yaml
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Extend(frag, "discover"); err == nil || !strings.Contains(err.Error(), `repeated name "deploy_a"`) {
+		t.Errorf("got %v, want a repeated name error", err)
+	}
+	if len(c.Executions) != 4 {
+		t.Errorf("a bad fragment changed the config: %+v", c.Executions)
+	}
+}
+
+func TestMatrixParse(t *testing.T) {
+	c, err := Parse(strings.NewReader(`
+exec: build() build.yaml
+exec: test[go=1.8,1.9; os=linux,alpine](build) test.yaml
+exec: report(test as results) report.yaml
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range c.Executions {
+		names = append(names, e.Name)
+	}
+	if want := []string{"build", "test-1.8-linux", "test-1.8-alpine", "test-1.9-linux", "test-1.9-alpine", "report"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got executions %q, want %q", names, want)
+	}
+
+	test := c.Executions[2]
+	if test.Group != "test" || !reflect.DeepEqual(test.Params, []Param{{Name: "build"}}) {
+		t.Errorf("got %+v, want a member of test that depends on build", test)
+	}
+	if got, want := test.Substitutions(), map[string]string{"_GO": "1.8", "_OS": "alpine"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got substitutions %v, want %v", got, want)
+	}
+
+	var locals []string
+	for _, p := range c.Executions[5].Params {
+		locals = append(locals, p.LocalName())
+	}
+	if want := []string{"results-1.8-linux", "results-1.8-alpine", "results-1.9-linux", "results-1.9-alpine"}; !reflect.DeepEqual(locals, want) {
+		t.Errorf("report gets artifacts in %q, want %q", locals, want)
+	}
+}
+
+func TestParameters(t *testing.T) {
+	c, err := Parse(strings.NewReader(`
+param: region = us-central1
+param: env
+param: note =
+exec: deploy() deploy.yaml
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Parameter{
+		{Name: "region", Default: "us-central1"},
+		{Name: "env", Required: true},
+		{Name: "note"},
+	}
+	if !reflect.DeepEqual(c.Parameters, want) {
+		t.Errorf("got %+v, want %+v", c.Parameters, want)
+	}
+
+	got, err := c.ResolveParameters(map[string]string{"env": "dev"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"region": "us-central1", "env": "dev", "note": ""}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := c.ResolveParameters(nil); err == nil || err.Error() != "missing required params: env" {
+		t.Errorf("got %v, want a missing env", err)
+	}
+	if _, err := c.ResolveParameters(map[string]string{"env": "dev", "zone": "a"}); err == nil || err.Error() != "unknown params: zone" {
+		t.Errorf("got %v, want an unknown zone", err)
+	}
+
+	for _, bad := range []string{
+		"param: workflow_id",
+		"param: env\nparam: ENV = x",
+		"param: my-param",
+	} {
+		if _, err := Parse(strings.NewReader(bad)); err == nil {
+			t.Errorf("parsed %q", bad)
+		}
+	}
+}
+
+func TestBlockParse(t *testing.T) {
+	c, err := Parse(strings.NewReader(`
+exec: build() {
+    steps:
+    - name: 'gcr.io/cloud-builders/go'
+      args: ['build', '.']
+}
+exec: test(build) test.yaml
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	build := c.Executions[0]
+	want := `steps:
+- name: 'gcr.io/cloud-builders/go'
+  args: ['build', '.']
+`
+	if build.Body != want || build.Path != "" {
+		t.Errorf("got body %q and path %q, want body %q", build.Body, build.Path, want)
+	}
+	if len(c.Executions) != 2 || c.Executions[1].Path != "test.yaml" {
+		t.Errorf("got %+v, want test after the block", c.Executions)
+	}
+
+	// Positions after a block still count its lines.
+	_, err = Parse(strings.NewReader(`
+exec: build() {
+  steps: []
+}
+exec: test(biuld) test.yaml
+`))
+	if err == nil || !strings.HasPrefix(err.Error(), "5:12: ") {
+		t.Errorf("got %v, want an error at 5:12", err)
+	}
+
+	if _, err := Parse(strings.NewReader("exec: build() {\n  steps: []\n")); err == nil || err.Error() != "line 1: expected '}' to end the block" {
+		t.Errorf("got %v, want an unterminated block", err)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	files := map[string]string{
+		"gs://bucket/wf/main.wf": `
+import "../lib/go.wf" as golang
+template: deploy(env) {
+  steps: []
+}
+exec: test[goversion=1.8,1.9]() use golang.test(pkg = flargo)
+exec: deploy_dev(test) use deploy(env = dev)
+`,
+		"gs://bucket/lib/go.wf": `
+template: test(pkg, goversion = 1.9) test.yaml
+`,
+		"gs://bucket/lib/test.yaml": "steps: []\n",
+	}
+	open := func(path string) (io.ReadCloser, error) {
+		data, ok := files[path]
+		if !ok {
+			return nil, fmt.Errorf("no file %q", path)
+		}
+		return ioutil.NopCloser(strings.NewReader(data)), nil
+	}
+
+	c, err := LoadFrom("gs://bucket/wf/main.wf", open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Executions) != 3 {
+		t.Fatalf("got %d executions, want 3", len(c.Executions))
+	}
+	test := c.Executions[0]
+	if test.Template != "golang.test" || test.Body != "steps: []\n" {
+		t.Errorf("got template %q and body %q, want golang.test from test.yaml", test.Template, test.Body)
+	}
+	want := map[string]string{"_PKG": "flargo", "_GOVERSION": "1.8"}
+	if got := test.Substitutions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got substitutions %v, want %v", got, want)
+	}
+	deploy := c.Executions[2]
+	if deploy.Template != "deploy" || !reflect.DeepEqual(deploy.Args, map[string]string{"env": "dev"}) {
+		t.Errorf("got template %q with %v, want deploy with env=dev", deploy.Template, deploy.Args)
+	}
+
+	for _, tc := range []struct {
+		config string
+		want   string
+	}{
+		{"exec: a() use nothing()", `line 1: unknown template "nothing"`},
+		{"exec: a() use lib.t()", `line 1: unknown namespace "lib"`},
+		{"template: t(x) {\n}\nexec: a() use t()", `line 3: template "t": missing required params: x`},
+		{"template: t() {\n}\nexec: a() use t(y = 1)", `line 3: template "t": unknown params: y`},
+		{"template: t() {\n}\nwait: a() use t()", "line 3: only exec executions can use a template"},
+		{`import "missing.wf" as lib`, `line 1: could not import: could not open "missing.wf": no file "missing.wf"`},
+		{`import "gs://bucket/wf/main.wf" as lib`, `line 1: "gs://bucket/wf/main.wf" may only define templates`},
+	} {
+		files["other.wf"] = tc.config
+		if _, err := LoadFrom("other.wf", open); err == nil || err.Error() != `could not parse "other.wf": `+tc.want {
+			t.Errorf("%q: got %v, want %q", tc.config, err, tc.want)
+		}
+	}
+}
+
+func TestConditionParse(t *testing.T) {
+	c, err := Parse(strings.NewReader(`
+param: env
+exec: test() test.yaml
+exec: notify(test) if failure(test) notify.yaml
+exec: deploy(test) if param.env != "dev prod" {
+  steps: []
+}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.Executions[1].When, (&Condition{Outcome: OutcomeFailure, Execution: "test"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got := c.Executions[1].Path; got != "notify.yaml" {
+		t.Errorf("got path %q, want notify.yaml", got)
+	}
+	deploy := c.Executions[2]
+	if got, want := deploy.When, (&Condition{Param: "env", Op: "!=", Value: "dev prod"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if deploy.Body == "" || !deploy.When.Compare("dev") || deploy.When.Compare("dev prod") {
+		t.Errorf("got %+v, want an inline build that runs unless env is 'dev prod'", deploy)
+	}
+
+	for _, tc := range []struct {
+		config string
+		want   string
+	}{
+		{"exec: a() b.yaml\nexec: c() if success(a) c.yaml", `2:11: "c" has a condition on "a", which it does not depend on`},
+		{"exec: a() if param.env == \"x\" a.yaml", `1:11: "a" has a condition on undeclared param "env"`},
+		{"exec: a() if param.env = \"x\" a.yaml", "1:11: expected '==' or '!='"},
+		{"exec: a() if param.env == x a.yaml", `1:11: expected a quoted value after "=="`},
+		{"exec: a() if done(b) a.yaml", `1:11: expected 'success(...)', 'failure(...)' or 'param.name == "value"'`},
+	} {
+		if _, err := Parse(strings.NewReader(tc.config)); err == nil || err.Error() != tc.want {
+			t.Errorf("%q: got %v, want %q", tc.config, err, tc.want)
+		}
+	}
+}
+
+func TestRetryParse(t *testing.T) {
+	c, err := Parse(strings.NewReader(`
+exec: build() build.yaml
+exec: test(build) retries=3 backoff=10s if success(build) test.yaml
+exec: lint(build) retries=1 lint.yaml
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test := c.Executions[1]
+	if test.Retries != 3 || test.Backoff != 10*time.Second || test.When == nil || test.Path != "test.yaml" {
+		t.Errorf("got %+v, want 3 retries 10s apart", test)
+	}
+	for attempt, want := range map[int]time.Duration{1: 10 * time.Second, 2: 20 * time.Second, 3: 40 * time.Second} {
+		if got, ok := test.RetryDelay(attempt); !ok || got != want {
+			t.Errorf("after attempt %d, got %s, %t, want %s", attempt, got, ok, want)
+		}
+	}
+	if _, ok := test.RetryDelay(4); ok {
+		t.Errorf("attempt 4 is retried")
+	}
+	if got, _ := c.Executions[2].RetryDelay(1); got != DefaultBackoff {
+		t.Errorf("got %s, want the default backoff", got)
+	}
+	slow := Execution{Retries: MaxRetries, Backoff: 12 * time.Hour}
+	for attempt, want := range map[int]time.Duration{1: 12 * time.Hour, 2: MaxRetryDelay, MaxRetries: MaxRetryDelay} {
+		if got, ok := slow.RetryDelay(attempt); !ok || got != want {
+			t.Errorf("after attempt %d of %s backoff, got %s, %t, want %s", attempt, slow.Backoff, got, ok, want)
+		}
+	}
+
+	for _, tc := range []struct {
+		config string
+		want   string
+	}{
+		{"exec: a() retries=x a.yaml", `1:11: invalid retries "x"`},
+		{"exec: a() retries=100 a.yaml", `1:11: retries 100 is more than 10`},
+		{"exec: a() backoff=soon a.yaml", `1:11: invalid backoff "soon"`},
+		{"wait: a() retries=2 -", `1:11: only exec executions can have "retries=2"`},
+		{"exec: a() timeout=0s a.yaml", `1:11: invalid timeout "0s"`},
+	} {
+		if _, err := Parse(strings.NewReader(tc.config)); err == nil || err.Error() != tc.want {
+			t.Errorf("%q: got %v, want %q", tc.config, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+An execution with a matrix, such as
+
+	exec: test[go=1.8,1.9; os=linux,alpine](build) test.yaml
+
+stands for one execution per combination of values, named after its values in
+order: test-1.8-linux, test-1.8-alpine, test-1.9-linux and test-1.9-alpine.
+Together they are the group "test", and depending on the group depends on all
+of them. Each gets its values as the substitutions _GO and _OS.
+*/
+
+// A dimension is one key of a matrix and the values it takes.
+type dimension struct {
+	key    string
+	values []string
+}
+
+// parseMatrix splits an execution's name from its matrix, if it has one.
+func parseMatrix(s string) (string, []dimension, error) {
+	open := strings.Index(s, "[")
+	if open == -1 {
+		return s, nil, nil
+	}
+	if !strings.HasSuffix(s, "]") {
+		return "", nil, fmt.Errorf("expected ']' at the end of %q", s)
+	}
+	name := strings.TrimSpace(s[:open])
+	var dims []dimension
+	keys := map[string]bool{}
+	for _, d := range strings.Split(s[open+1:len(s)-1], ";") {
+		tokens := strings.SplitN(d, "=", 2)
+		if len(tokens) != 2 {
+			return "", nil, fmt.Errorf("expected 'key=value,...' in matrix, got %q", strings.TrimSpace(d))
+		}
+		dim := dimension{key: strings.TrimSpace(tokens[0])}
+		if !isToken(dim.key, false) {
+			return "", nil, fmt.Errorf("invalid matrix key %q", dim.key)
+		}
+		if reservedSubstitutions[SubstitutionKey(dim.key)] {
+			return "", nil, fmt.Errorf("matrix key %q is set by flargo", dim.key)
+		}
+		if keys[dim.key] {
+			return "", nil, fmt.Errorf("repeated matrix key %q", dim.key)
+		}
+		keys[dim.key] = true
+		seen := map[string]bool{}
+		for _, v := range strings.Split(tokens[1], ",") {
+			v = strings.TrimSpace(v)
+			if !isToken(v, true) {
+				return "", nil, fmt.Errorf("invalid value %q for matrix key %q", v, dim.key)
+			}
+			if seen[v] {
+				return "", nil, fmt.Errorf("repeated value %q for matrix key %q", v, dim.key)
+			}
+			seen[v] = true
+			dim.values = append(dim.values, v)
+		}
+		dims = append(dims, dim)
+	}
+	return name, dims, nil
+}
+
+// isToken is true if s can be a matrix key or param name, or a matrix value if
+// value is set. Values end up in execution names, so they are kept to
+// characters that are safe there.
+func isToken(s string, value bool) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+		case value && (r == '.' || r == '-'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// expandMatrix makes one execution for each combination of values.
+func expandMatrix(e Execution, dims []dimension) []Execution {
+	first := e
+	first.Group = e.Name
+	first.Matrix = map[string]string{}
+	members := []Execution{first}
+	for _, dim := range dims {
+		var next []Execution
+		for _, m := range members {
+			for _, v := range dim.values {
+				n := m
+				n.Name = m.Name + "-" + v
+				n.Matrix = map[string]string{}
+				for k, mv := range m.Matrix {
+					n.Matrix[k] = mv
+				}
+				n.Matrix[dim.key] = v
+				next = append(next, n)
+			}
+		}
+		members = next
+	}
+	return members
+}
+
+// Substitutions has the cloudbuild substitutions for the execution's template
+// args and matrix values, if it has any. Matrix values take precedence.
+func (e Execution) Substitutions() map[string]string {
+	if len(e.Args) == 0 && len(e.Matrix) == 0 {
+		return nil
+	}
+	subs := map[string]string{}
+	for k, v := range e.Args {
+		subs[SubstitutionKey(k)] = v
+	}
+	for k, v := range e.Matrix {
+		subs[SubstitutionKey(k)] = v
+	}
+	return subs
+}
+
+// expandGroups replaces each dependency on a group with dependencies on all of
+// its members. With an alias, each member's artifacts go under the alias
+// followed by the member's values.
+func expandGroups(c *Config) error {
+	groups := map[string][]string{}
+	for _, e := range c.Executions {
+		if e.Group != "" {
+			groups[e.Group] = append(groups[e.Group], e.Name)
+		}
+	}
+	if len(groups) == 0 {
+		return nil
+	}
+
+	for i := range c.Executions {
+		e := &c.Executions[i]
+		var params []Param
+		var positions []Pos
+		localNames := map[string]bool{}
+		for j, p := range e.Params {
+			ps := []Param{p}
+			if members, ok := groups[p.Name]; ok {
+				ps = nil
+				for _, m := range members {
+					mp := Param{Name: m}
+					if p.Alias != "" {
+						mp.Alias = p.Alias + strings.TrimPrefix(m, p.Name)
+					}
+					ps = append(ps, mp)
+				}
+			}
+			for _, mp := range ps {
+				if localNames[mp.LocalName()] {
+					return c.errorf(c.paramPos(i, j), "repeated param name %q", mp.LocalName())
+				}
+				localNames[mp.LocalName()] = true
+				if pos := c.paramPos(i, j); pos != nil {
+					positions = append(positions, *pos)
+				}
+			}
+			params = append(params, ps...)
+		}
+		if i < len(c.positions) {
+			c.positions[i].params = positions
+		}
+		e.Params = params
+	}
+	return nil
+}
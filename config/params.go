@@ -0,0 +1,107 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// TypeParam declares a workflow parameter, rather than an execution.
+//
+//	param: region = us-central1
+//	param: env
+//
+// A parameter with a default may be left out when the workflow is started, and
+// one without must be given. Each build gets the value of every parameter as a
+// substitution, named like _REGION.
+const TypeParam = "param"
+
+// A Parameter is a value given when a workflow is started.
+type Parameter struct {
+	Name     string
+	Default  string `json:",omitempty"`
+	Required bool   `json:",omitempty"`
+}
+
+// SubstitutionKey is the cloudbuild substitution that the named value is
+// given to builds as.
+func SubstitutionKey(name string) string {
+	return "_" + strings.ToUpper(name)
+}
+
+// reservedSubstitutions are set by flargo for every build.
+var reservedSubstitutions = map[string]bool{
+	"_WORKFLOW_ID":      true,
+	"_EXECUTION_NAME":   true,
+	"_ARTIFACTS_PREFIX": true,
+}
+
+// parseParameter reads what follows "param:".
+func parseParameter(s string) (Parameter, error) {
+	var p Parameter
+	tokens := strings.SplitN(s, "=", 2)
+	p.Name = strings.TrimSpace(tokens[0])
+	if len(tokens) == 2 {
+		p.Default = strings.TrimSpace(tokens[1])
+	} else {
+		p.Required = true
+	}
+	if !isToken(p.Name, false) {
+		return p, fmt.Errorf("invalid param name %q", p.Name)
+	}
+	if reservedSubstitutions[SubstitutionKey(p.Name)] {
+		return p, fmt.Errorf("param %q is set by flargo", p.Name)
+	}
+	return p, nil
+}
+
+// ResolveParameters fills in defaults for the parameters not in values. It is
+// an error to leave out a required parameter, or to give one the config does
+// not declare.
+func (c *Config) ResolveParameters(values map[string]string) (map[string]string, error) {
+	return resolveValues(c.Parameters, values)
+}
+
+func resolveValues(params []Parameter, values map[string]string) (map[string]string, error) {
+	resolved := map[string]string{}
+	declared := map[string]bool{}
+	var missing []string
+	for _, p := range params {
+		declared[p.Name] = true
+		v, ok := values[p.Name]
+		switch {
+		case ok:
+			resolved[p.Name] = v
+		case p.Required:
+			missing = append(missing, p.Name)
+		default:
+			resolved[p.Name] = p.Default
+		}
+	}
+	var unknown []string
+	for name := range values {
+		if !declared[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	if len(unknown) != 0 {
+		return nil, fmt.Errorf("unknown params: %s", strings.Join(unknown, ", "))
+	}
+	if len(missing) != 0 {
+		return nil, fmt.Errorf("missing required params: %s", strings.Join(missing, ", "))
+	}
+	return resolved, nil
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultBackoff is how long to wait before the first automatic retry of an
+// execution that does not say.
+const DefaultBackoff = 30 * time.Second
+
+// MaxRetries is the most automatic retries an execution may ask for.
+const MaxRetries = 10
+
+// MaxRetryDelay caps the backoff between retries at the longest cloudbuild lets
+// a build run.
+const MaxRetryDelay = 24 * time.Hour
+
+// parseAnnotation reads a 'retries=N', 'backoff=DURATION' or
+// 'timeout=DURATION' annotation into e.
+//
+//	exec: integration(build) retries=3 backoff=30s timeout=20m integration.yaml
+func parseAnnotation(e *Execution, field string) error {
+	if e.Type != TypeExec {
+		return fmt.Errorf("only exec executions can have %q", field)
+	}
+	tokens := strings.SplitN(field, "=", 2)
+	switch tokens[0] {
+	case "retries":
+		n, err := strconv.Atoi(tokens[1])
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid retries %q", tokens[1])
+		}
+		if n > MaxRetries {
+			return fmt.Errorf("retries %d is more than %d", n, MaxRetries)
+		}
+		e.Retries = n
+	case "backoff", "timeout":
+		d, err := time.ParseDuration(tokens[1])
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid %s %q", tokens[0], tokens[1])
+		}
+		if tokens[0] == "backoff" {
+			e.Backoff = d
+		} else {
+			e.Timeout = d
+		}
+	}
+	return nil
+}
+
+// RetryDelay is how long to wait before retrying the execution once the given
+// attempt has failed, or false if it is not to be retried automatically. The
+// backoff doubles with each attempt, up to MaxRetryDelay.
+func (e Execution) RetryDelay(attempt int) (time.Duration, bool) {
+	if attempt < 1 || attempt > e.Retries {
+		return 0, false
+	}
+	backoff := e.Backoff
+	if backoff == 0 {
+		backoff = DefaultBackoff
+	}
+	delay := backoff
+	for i := 1; i < attempt && delay < MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > MaxRetryDelay {
+		delay = MaxRetryDelay
+	}
+	return delay, true
+}
@@ -0,0 +1,254 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package config
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// TypeTemplate declares a build that exec executions can share, with args
+// that are given to it as substitutions.
+//
+//	template: go_test(pkg, goversion = 1.9) go_test.yaml
+//	exec: test_flargo() use go_test(pkg = flargo)
+//
+// Templates can be kept in a file of their own, and imported under a
+// namespace.
+//
+//	import "gs://my-bucket/templates.wf" as lib
+//	exec: test_flargo() use lib.go_test(pkg = flargo)
+const TypeTemplate = "template"
+
+// A template is a build that is not run until an execution uses it.
+type template struct {
+	Name   string
+	Params []Parameter
+	// Path is the template's build file, relative to source, or Body is the
+	// build itself.
+	Path   string
+	Body   string
+	source string
+}
+
+// An importDecl brings the templates of another file into a namespace.
+type importDecl struct {
+	path string
+	ns   string
+	line int
+}
+
+// A templateUse is an execution's reference to a template.
+type templateUse struct {
+	ns   string
+	name string
+	args map[string]string
+	line int
+}
+
+// An Opener reads the file at a path, which may be a local file or a GCS URL.
+type Opener func(path string) (io.ReadCloser, error)
+
+// OpenFile is an Opener for local files.
+func OpenFile(path string) (io.ReadCloser, error) {
+	if strings.HasPrefix(path, "gs://") {
+		return nil, fmt.Errorf("cannot read %q without GCS", path)
+	}
+	return os.Open(path)
+}
+
+// parseImport reads a line like 'import "path" as ns'.
+func parseImport(s string) (importDecl, error) {
+	var imp importDecl
+	s = strings.TrimSpace(s[len("import"):])
+	if !strings.HasPrefix(s, `"`) {
+		return imp, fmt.Errorf(`expected 'import "path" as ns'`)
+	}
+	quoteStop := strings.Index(s[1:], `"`)
+	if quoteStop == -1 {
+		return imp, fmt.Errorf("unterminated import path")
+	}
+	imp.path = s[1 : quoteStop+1]
+	tokens := strings.Fields(s[quoteStop+2:])
+	if imp.path == "" || len(tokens) != 2 || tokens[0] != "as" {
+		return imp, fmt.Errorf(`expected 'import "path" as ns'`)
+	}
+	imp.ns = tokens[1]
+	if !isToken(imp.ns, false) {
+		return imp, fmt.Errorf("invalid namespace %q", imp.ns)
+	}
+	return imp, nil
+}
+
+// parseTemplate reads what follows 'template:'. If the build is inline, Path is
+// left as "{".
+func parseTemplate(s string) (*template, error) {
+	s = strings.TrimSpace(s)
+	parenStop := strings.Index(s, "(")
+	if parenStop == -1 {
+		return nil, fmt.Errorf("expected 'name ('")
+	}
+	t := &template{Name: strings.TrimSpace(s[:parenStop])}
+	if !isToken(t.Name, false) {
+		return nil, fmt.Errorf("invalid template name %q", t.Name)
+	}
+	s = s[parenStop+1:]
+	parenStop = strings.Index(s, ")")
+	if parenStop == -1 {
+		return nil, fmt.Errorf("expected '( param, param, ... )'")
+	}
+	for _, pt := range strings.Split(s[:parenStop], ",") {
+		if strings.TrimSpace(pt) == "" {
+			continue
+		}
+		p, err := parseParameter(pt)
+		if err != nil {
+			return nil, err
+		}
+		for _, q := range t.Params {
+			if q.Name == p.Name {
+				return nil, fmt.Errorf("repeated param %q", p.Name)
+			}
+		}
+		t.Params = append(t.Params, p)
+	}
+	t.Path = strings.TrimSpace(s[parenStop+1:])
+	if t.Path == "" {
+		return nil, fmt.Errorf("template %q has no build", t.Name)
+	}
+	return t, nil
+}
+
+// parseUse reads what follows 'use', like 'ns.name(key = value, ...)'.
+func parseUse(s string) (*templateUse, error) {
+	s = strings.TrimSpace(s)
+	parenStop := strings.Index(s, "(")
+	if parenStop == -1 || !strings.HasSuffix(s, ")") {
+		return nil, fmt.Errorf("expected 'use template( key = value, ... )'")
+	}
+	u := &templateUse{
+		name: strings.TrimSpace(s[:parenStop]),
+		args: map[string]string{},
+	}
+	if dot := strings.Index(u.name, "."); dot != -1 {
+		u.ns, u.name = u.name[:dot], u.name[dot+1:]
+		if !isToken(u.ns, false) {
+			return nil, fmt.Errorf("invalid namespace %q", u.ns)
+		}
+	}
+	if !isToken(u.name, false) {
+		return nil, fmt.Errorf("invalid template name %q", u.name)
+	}
+	for _, at := range strings.Split(s[parenStop+1:len(s)-1], ",") {
+		if strings.TrimSpace(at) == "" {
+			continue
+		}
+		tokens := strings.SplitN(at, "=", 2)
+		if len(tokens) != 2 {
+			return nil, fmt.Errorf("expected 'key = value', got %q", strings.TrimSpace(at))
+		}
+		k := strings.TrimSpace(tokens[0])
+		if _, ok := u.args[k]; ok {
+			return nil, fmt.Errorf("repeated arg %q", k)
+		}
+		u.args[k] = strings.TrimSpace(tokens[1])
+	}
+	return u, nil
+}
+
+// resolve reads the config's imports and gives every execution that uses a
+// template the template's build. Paths are relative to the config at base.
+func (c *Config) resolve(base string, open Opener) error {
+	namespaces := map[string]map[string]*template{}
+	for _, imp := range c.imports {
+		if _, ok := namespaces[imp.ns]; ok {
+			return fmt.Errorf("line %d: repeated namespace %q", imp.line, imp.ns)
+		}
+		p := resolvePath(base, imp.path)
+		ic, err := read(p, open)
+		if err != nil {
+			return fmt.Errorf("line %d: could not import: %v", imp.line, err)
+		}
+		if len(ic.Executions) != 0 || len(ic.Parameters) != 0 || len(ic.imports) != 0 {
+			return fmt.Errorf("line %d: %q may only define templates", imp.line, imp.path)
+		}
+		for _, t := range ic.templates {
+			t.source = p
+		}
+		namespaces[imp.ns] = ic.templates
+	}
+	for _, t := range c.templates {
+		t.source = base
+	}
+
+	for i := range c.Executions {
+		e := &c.Executions[i]
+		if e.use == nil {
+			continue
+		}
+		templates, ref := c.templates, e.use.name
+		if e.use.ns != "" {
+			var ok bool
+			if templates, ok = namespaces[e.use.ns]; !ok {
+				return fmt.Errorf("line %d: unknown namespace %q", e.use.line, e.use.ns)
+			}
+			ref = e.use.ns + "." + e.use.name
+		}
+		t, ok := templates[e.use.name]
+		if !ok {
+			return fmt.Errorf("line %d: unknown template %q", e.use.line, ref)
+		}
+		args, err := resolveValues(t.Params, e.use.args)
+		if err != nil {
+			return fmt.Errorf("line %d: template %q: %v", e.use.line, ref, err)
+		}
+		body := t.Body
+		if t.Path != "" {
+			if body, err = readFile(resolvePath(t.source, t.Path), open); err != nil {
+				return fmt.Errorf("line %d: template %q: %v", e.use.line, ref, err)
+			}
+		}
+		e.Template, e.Args, e.Body = ref, args, body
+		e.use = nil
+	}
+	return nil
+}
+
+// resolvePath finds rel relative to the directory of the file at base.
+func resolvePath(base, rel string) string {
+	if strings.HasPrefix(rel, "gs://") || filepath.IsAbs(rel) {
+		return rel
+	}
+	if strings.HasPrefix(base, "gs://") {
+		return "gs://" + path.Join(path.Dir(strings.TrimPrefix(base, "gs://")), rel)
+	}
+	return filepath.Join(filepath.Dir(base), rel)
+}
+
+func readFile(path string, open Opener) (string, error) {
+	fin, err := open(path)
+	if err != nil {
+		return "", fmt.Errorf("could not open %q: %v", path, err)
+	}
+	defer fin.Close()
+	data, err := ioutil.ReadAll(fin)
+	if err != nil {
+		return "", fmt.Errorf("could not read %q: %v", path, err)
+	}
+	return string(data), nil
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Validate checks that the executions form a workflow that can finish: names
+// are unique, and every dependency is on an execution defined earlier in the
+// config. Anything else would leave a wait step blocked forever.
+func Validate(c *Config) error {
+	index := map[string]int{}
+	for i, e := range c.Executions {
+		if _, ok := index[e.Name]; ok {
+			return c.errorf(c.namePos(i), "repeated name %q", e.Name)
+		}
+		index[e.Name] = i
+	}
+	groups := map[string]bool{}
+	for i, e := range c.Executions {
+		if _, ok := index[e.Group]; ok && e.Group != "" {
+			return c.errorf(c.namePos(i), "repeated name %q", e.Group)
+		}
+		groups[e.Group] = e.Group != ""
+	}
+
+	for i, e := range c.Executions {
+		for j, p := range e.Params {
+			if p.Name == e.Name {
+				return c.errorf(c.paramPos(i, j), "%q depends on itself", e.Name)
+			}
+			if _, ok := index[p.Name]; !ok {
+				return c.errorf(c.paramPos(i, j), "%q depends on undefined execution %q", e.Name, p.Name)
+			}
+		}
+	}
+
+	for i, e := range c.Executions {
+		if e.When == nil {
+			continue
+		}
+		// A group has no single outcome to check.
+		if e.When.Outcome != "" && groups[e.When.Execution] {
+			return c.errorf(c.whenPos(i), "%q has a condition on matrix %q, which can only check one of its executions", e.Name, e.When.Execution)
+		}
+		if e.When.Outcome != "" && !dependsOn(e, e.When.Execution) {
+			return c.errorf(c.whenPos(i), "%q has a condition on %q, which it does not depend on", e.Name, e.When.Execution)
+		}
+		if e.When.Param != "" && !c.declares(e.When.Param) {
+			return c.errorf(c.whenPos(i), "%q has a condition on undeclared param %q", e.Name, e.When.Param)
+		}
+	}
+
+	// Look for cycles before forward references, since every cycle has one
+	// and saying it's a cycle is more helpful.
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	marks := make([]int, len(c.Executions))
+	var path []string
+	var visit func(i int) error
+	visit = func(i int) error {
+		marks[i] = visiting
+		path = append(path, c.Executions[i].Name)
+		for j, p := range c.Executions[i].Params {
+			dep := index[p.Name]
+			switch marks[dep] {
+			case visiting:
+				var cycle []string
+				for k, name := range path {
+					if name == p.Name {
+						cycle = append(cycle, path[k:]...)
+						break
+					}
+				}
+				cycle = append(cycle, p.Name)
+				return c.errorf(c.paramPos(i, j), "dependency cycle %s", strings.Join(cycle, " -> "))
+			case unvisited:
+				if err := visit(dep); err != nil {
+					return err
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		marks[i] = visited
+		return nil
+	}
+	for i := range c.Executions {
+		if marks[i] == unvisited {
+			if err := visit(i); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i, e := range c.Executions {
+		for j, p := range e.Params {
+			if dep := index[p.Name]; dep > i {
+				return c.errorf(c.paramPos(i, j), "%q depends on %q, which must be defined earlier", e.Name, p.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+func dependsOn(e Execution, name string) bool {
+	for _, p := range e.Params {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) declares(param string) bool {
+	for _, p := range c.Parameters {
+		if p.Name == param {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) namePos(i int) *Pos {
+	if i >= len(c.positions) {
+		return nil
+	}
+	return &c.positions[i].name
+}
+
+func (c *Config) paramPos(i, j int) *Pos {
+	if i >= len(c.positions) || j >= len(c.positions[i].params) {
+		return nil
+	}
+	return &c.positions[i].params[j]
+}
+
+func (c *Config) whenPos(i int) *Pos {
+	if i >= len(c.positions) {
+		return nil
+	}
+	return &c.positions[i].when
+}
+
+// errorf prefixes the error with its position, if the config came from a file.
+func (c *Config) errorf(pos *Pos, format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	if pos == nil {
+		return errors.New(msg)
+	}
+	return fmt.Errorf("%s: %s", pos, msg)
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config string
+		err    string
+	}{{
+		name: "diamond",
+		config: `
+exec: start() start.yaml
+exec: left(start) left.yaml
+exec: right(start) right.yaml
+exec: join(left, right) join.yaml
+`,
+	}, {
+		name: "repeated name",
+		config: `
+exec: build() build.yaml
+exec:  build() build.yaml
+`,
+		err: `3:8: repeated name "build"`,
+	}, {
+		name: "undefined",
+		config: `
+exec: build() build.yaml
+exec: test(build, buidl) test.yaml
+`,
+		err: `3:19: "test" depends on undefined execution "buidl"`,
+	}, {
+		name: "self",
+		config: `
+exec: build(build as me) build.yaml
+`,
+		err: `2:13: "build" depends on itself`,
+	}, {
+		name: "forward reference",
+		config: `
+exec: test(build) test.yaml
+exec: build() build.yaml
+`,
+		err: `2:12: "test" depends on "build", which must be defined earlier`,
+	}, {
+		name: "cycle",
+		config: `
+exec: a(c) a.yaml
+exec: b(a) b.yaml
+exec: c(b) c.yaml
+`,
+		err: `3:9: dependency cycle a -> c -> b -> a`,
+	}, {
+		name: "bad param",
+		config: `
+exec: build() build.yaml
+exec: test(build,  build like b) test.yaml
+`,
+		err: `3:20: wrong number of tokens`,
+	}, {
+		name: "group and execution",
+		config: `
+exec: test() test.yaml
+exec: test[go=1.8,1.9]() test.yaml
+`,
+		err: `3:7: repeated name "test"`,
+	}, {
+		name: "bad matrix",
+		config: `
+exec: test[go=1.8,1 9]() test.yaml
+`,
+		err: `2:7: invalid value "1 9" for matrix key "go"`,
+	}, {
+		name: "group alias",
+		config: `
+exec: test[go=1.8,1.9]() test.yaml
+exec: deploy(test as t, test-1.8 as t-1.8) deploy.yaml
+`,
+		err: `3:25: repeated param name "t-1.8"`,
+	}, {
+		name: "condition on group",
+		config: `
+exec: test[go=1.8,1.9]() test.yaml
+exec: notify(test) if failure(test) notify.yaml
+`,
+		err: `3:20: "notify" has a condition on matrix "test", which can only check one of its executions`,
+	}, {
+		name: "condition on group member",
+		config: `
+exec: test[go=1.8,1.9]() test.yaml
+exec: notify(test) if failure(test-1.8) notify.yaml
+`,
+	}} {
+		_, err := Parse(strings.NewReader(tc.config))
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		case tc.err != "" && err == nil:
+			t.Errorf("%s: expected error %q", tc.name, tc.err)
+		case tc.err != "" && !strings.Contains(err.Error(), tc.err):
+			t.Errorf("%s: got error %q, want %q", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestValidateWithoutPositions(t *testing.T) {
+	c := &Config{
+		Executions: []Execution{{
+			Type:   TypeExec,
+			Name:   "test",
+			Params: []Param{{Name: "build"}},
+		}},
+	}
+	err := Validate(c)
+	if err == nil || err.Error() != `"test" depends on undefined execution "build"` {
+		t.Errorf("got %v", err)
+	}
+}
@@ -13,25 +13,35 @@ limitations under the License.
 package main
 
 import (
-	"encoding/base64"
-	"fmt"
-	"io"
 	"log"
 	"os"
-	"strings"
-	"time"
 
 	"cloud.google.com/go/compute/metadata"
+	"cloud.google.com/go/storage"
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+	v1cloudbuild "google.golang.org/api/cloudbuild/v1"
+	"google.golang.org/api/option"
 	pubsub_v1 "google.golang.org/api/pubsub/v1"
+
+	"github.com/skelterjohn/flargo/executions"
+	"github.com/skelterjohn/flargo/workflow"
 )
 
 /*
-The coord program listens for certain kinds of messages on a pubsub subscription
-(which must already exist), and prints them to stdout so that they can be reviewed
-by flargo.
+The coord program creates the workflow topic and a subscription to it, and
+prints every message published there to stdout so that it can be reviewed by
+flargo. Each message also goes in the workflow's event log in GCS, which
+outlives the build log.
+
+It also watches the build of each execution that has started, and publishes a
+failure message for any that fail, since those never publish anything themselves.
+
+The messages are also the events of the workflow's state machine. From them
+coord announces executions as they are unblocked and the workflow's result, and
+it exits with that result, so the coord build succeeds or fails with the
+workflow.
 */
 
 func init() {
@@ -43,7 +53,7 @@ func main() {
 	ctx := context.Background()
 
 	if len(os.Args) != 2 {
-		fmt.Println("Usage: %s ID", os.Args[0])
+		log.Fatalf("Usage: %s ID", os.Args[0])
 	}
 
 	workflowID := os.Args[1]
@@ -59,46 +69,37 @@ func main() {
 		log.Fatalf("Could not create pubsub client: %v", err)
 	}
 
-	tname := fmt.Sprintf("projects/%s/topics/workflow-%s", projectID, workflowID)
-
-	if _, err := pubsub.Projects.Topics.Create(tname, &pubsub_v1.Topic{
-		Name: workflowID,
-	}).Do(); err != nil {
-		log.Fatalf("Could not create topic: %v", err)
+	sc, err := storage.NewClient(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		log.Fatalf("Could not create storage client: %v", err)
 	}
 
-	log.Printf("Created topic %q", tname)
-
-	sname := fmt.Sprintf("projects/%s/subscriptions/coord-%s", projectID, workflowID)
-
-	if _, err := pubsub.Projects.Subscriptions.Create(sname, &pubsub_v1.Subscription{
-		Name:  "coord-" + workflowID,
-		Topic: tname,
-	}).Do(); err != nil {
-		log.Fatalf("Could not create subscription: %v", err)
+	cb, err := v1cloudbuild.New(client)
+	if err != nil {
+		log.Fatalf("Could not create cloudbuild client: %v", err)
 	}
 
-	for {
-		time.Sleep(1 * time.Second)
-		resp, err := pubsub.Projects.Subscriptions.Pull(sname, &pubsub_v1.PullRequest{
-			MaxMessages: 1,
-		}).Do()
-		if err != nil {
-			log.Printf("Error pulling subscription %q: %v", sname, err)
-			continue
-		}
-		for _, rmsg := range resp.ReceivedMessages {
-			// ack rmsg.AckId
-			msg := rmsg.Message.Data
-
-			io.Copy(os.Stdout, base64.NewDecoder(base64.StdEncoding, strings.NewReader(msg)))
-			fmt.Println()
-
-			if _, err := pubsub.Projects.Subscriptions.Acknowledge(sname, &pubsub_v1.AcknowledgeRequest{
-				AckIds: []string{rmsg.AckId},
-			}).Do(); err != nil {
-				log.Printf("Failed to ack message %q: %v", rmsg.AckId, err)
+	builds := executions.CloudBuild{
+		ProjectID: projectID,
+		Builds:    cb,
+	}
+	c := &workflow.Coordinator{
+		ProjectID:  projectID,
+		WorkflowID: workflowID,
+		PubSub:     pubsub,
+		Storage:    sc,
+		BuildStatus: func(ctx context.Context, buildID string) (string, error) {
+			b, err := cb.Projects.Builds.Get(projectID, buildID).Context(ctx).Do()
+			if err != nil {
+				return "", err
 			}
-		}
+			return b.Status, nil
+		},
+		Submit: builds.Submit,
+		Cancel: builds.Cancel,
+		Log:    os.Stdout,
+	}
+	if err := c.Run(ctx); err != nil {
+		log.Fatal(err)
 	}
 }
@@ -0,0 +1,196 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"golang.org/x/net/context"
+
+	"github.com/skelterjohn/flargo/config"
+	"github.com/skelterjohn/flargo/executions"
+	"github.com/skelterjohn/flargo/workflow"
+)
+
+type executionDescription struct {
+	Name       string              `json:"name"`
+	Type       string              `json:"type"`
+	Build      string              `json:"build,omitempty"`
+	Attempts   []workflow.Attempt  `json:"attempts,omitempty"`
+	Status     workflow.Status     `json:"status"`
+	BlockedBy  []string            `json:"blockedBy,omitempty"`
+	StartTime  string              `json:"startTime,omitempty"`
+	FinishTime string              `json:"finishTime,omitempty"`
+	Artifacts  string              `json:"artifacts"`
+	Reason     string              `json:"reason,omitempty"`
+	Manifest   []workflow.Artifact `json:"manifest,omitempty"`
+	Approval   *workflow.Approval  `json:"approval,omitempty"`
+	EmittedBy  string              `json:"emittedBy,omitempty"`
+	EmitError  string              `json:"emitError,omitempty"`
+	Condition  string              `json:"condition,omitempty"`
+	RetryAt    string              `json:"retryAt,omitempty"`
+}
+
+// describe writes the status of every execution in the workflow to w.
+func describe(ctx context.Context, e *env, workflowID, format string, w io.Writer) error {
+	if format != "table" && format != "json" {
+		return fmt.Errorf("unknown format %q", format)
+	}
+
+	state, err := loadState(ctx, e, workflowID)
+	if err != nil {
+		return err
+	}
+	if state.Config == nil {
+		return errors.New("workflow config not found")
+	}
+
+	var descs []executionDescription
+	for _, ce := range state.Config.Executions {
+		ex := state.Executions[ce.Name]
+		desc := executionDescription{
+			Name:      ce.Name,
+			Type:      ce.Type,
+			Build:     ex.Build,
+			Attempts:  ex.Attempts,
+			Status:    ex.Status,
+			Artifacts: fmt.Sprintf("%s/%s", workflow.ArtifactsPrefix(e.projectID, workflowID), ce.Name),
+			Reason:    ex.Reason,
+			Manifest:  ex.Manifest,
+			Approval:  ex.Approval,
+			EmittedBy: ex.EmittedBy,
+			EmitError: ex.EmitError,
+			RetryAt:   ex.RetryAt,
+		}
+		if ce.When != nil {
+			desc.Condition = ce.When.String()
+		}
+		if ce.Type == config.TypeWait && !ex.Status.Terminal() {
+			desc.Status = workflow.StatusWaiting
+			if state.Ready(ce.Name) {
+				desc.Status = workflow.StatusAwaitingApproval
+			}
+		}
+		if ex.Build != "" {
+			b, err := e.executions.FetchBuild(ctx, ex.Build)
+			if err != nil {
+				return fmt.Errorf("could not get %q build %s: %v", ce.Name, ex.Build, err)
+			}
+			desc.StartTime = b.StartTime
+			desc.FinishTime = b.FinishTime
+			switch {
+			case ex.Status.Terminal(), ex.Status == workflow.StatusRetrying:
+				// The topic already said how it ended.
+			case b.Status == "SUCCESS":
+				desc.Status = workflow.StatusSucceeded
+			case executions.BuildFailed(b.Status):
+				desc.Status = workflow.StatusFailed
+				desc.Reason = b.Status
+			case state.Ready(ce.Name):
+				desc.Status = workflow.StatusRunning
+			default:
+				desc.Status = workflow.StatusWaiting
+			}
+		}
+		if !desc.Status.Done() && state.Blocked(ce.Name) {
+			desc.Status = workflow.StatusBlocked
+			desc.BlockedBy = state.BlockedBy(ce.Name)
+		}
+		descs = append(descs, desc)
+	}
+
+	if format == "json" {
+		jdata, err := json.MarshalIndent(descs, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", jdata)
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tBUILD\tATTEMPT\tSTATUS\tBLOCKED BY\tSTARTED\tFINISHED\tARTIFACTS")
+	for _, d := range descs {
+		attempt := "-"
+		if len(d.Attempts) != 0 {
+			attempt = fmt.Sprint(d.Attempts[len(d.Attempts)-1].Number)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", d.Name, orDash(d.Build), attempt, d.Status, orDash(strings.Join(d.BlockedBy, ",")), orDash(d.StartTime), orDash(d.FinishTime), d.Artifacts)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	// Earlier attempts are listed after the table, so it stays one line per execution.
+	for _, d := range descs {
+		for i := 0; i < len(d.Attempts)-1; i++ {
+			a := d.Attempts[i]
+			fmt.Fprintf(w, "%s attempt %d was build %s", d.Name, a.Number, a.Build)
+			if a.Reason != "" {
+				fmt.Fprintf(w, ", which ended with %s", a.Reason)
+			}
+			fmt.Fprintln(w)
+		}
+		if d.Status == workflow.StatusRetrying {
+			fmt.Fprintf(w, "%s failed with %s, and will be retried at %s\n", d.Name, d.Reason, d.RetryAt)
+		}
+		if d.Status == workflow.StatusFailed && d.Reason != "" {
+			fmt.Fprintf(w, "%s failed with %s\n", d.Name, d.Reason)
+		}
+		if d.EmittedBy != "" {
+			fmt.Fprintf(w, "%s was added by %s\n", d.Name, d.EmittedBy)
+		}
+		if d.Condition != "" {
+			fmt.Fprintf(w, "%s runs if %s\n", d.Name, d.Condition)
+		}
+		if d.EmitError != "" {
+			fmt.Fprintf(w, "%s could not add executions: %s\n", d.Name, d.EmitError)
+		}
+		if a := d.Approval; a != nil {
+			fmt.Fprintf(w, "%s was approved by %s at %s", d.Name, a.By, a.At)
+			if a.Comment != "" {
+				fmt.Fprintf(w, ": %s", a.Comment)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+	var params []string
+	for k, v := range state.Options.Params {
+		params = append(params, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(params)
+	for _, p := range params {
+		fmt.Fprintf(w, "param %s\n", p)
+	}
+	switch {
+	case state.Cancelled:
+		fmt.Fprintln(w, "Workflow cancelled")
+	case state.TimedOut:
+		fmt.Fprintln(w, "Workflow timed out")
+	case state.Result != "":
+		fmt.Fprintf(w, "Workflow %s\n", state.Result)
+	}
+	return nil
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
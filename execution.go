@@ -0,0 +1,43 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"golang.org/x/net/context"
+	v1cloudbuild "google.golang.org/api/cloudbuild/v1"
+
+	"github.com/skelterjohn/flargo/config"
+	"github.com/skelterjohn/flargo/workflow"
+)
+
+// submitExecution creates the build for one attempt at an execution, and
+// announces it on the workflow topic. It returns the new build's ID.
+func submitExecution(ctx context.Context, e *env, workflowID string, build *v1cloudbuild.Build, execution config.Execution, attempt int) (string, error) {
+	buildID, err := e.executions.SubmitBuild(ctx, build)
+	if err != nil {
+		return "", fmt.Errorf("could not create %q execution: %v", execution.Name, err)
+	}
+	log.Printf("%q execution attempt %d is build %s", execution.Name, attempt, buildID)
+
+	if err := workflow.Publish(ctx, e.pubsub, workflow.TopicName(e.projectID, workflowID), workflow.Message{
+		Started: execution.Name,
+		Build:   buildID,
+		Attempt: attempt,
+	}); err != nil {
+		return "", err
+	}
+	return buildID, nil
+}
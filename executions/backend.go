@@ -0,0 +1,125 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package executions
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	v1cloudbuild "google.golang.org/api/cloudbuild/v1"
+)
+
+// The images flargo puts around an execution's own steps, and the image that
+// runs the coord step.
+const (
+	WaitImage     = "gcr.io/cloud-workflows/wait"
+	CompleteImage = "gcr.io/cloud-workflows/complete"
+	CoordImage    = "gcr.io/cloud-workflows/coord"
+)
+
+// A Backend runs builds. Builds are described the way cloudbuild describes
+// them, whatever actually runs them.
+type Backend interface {
+	// Submit starts running the build, and returns its ID.
+	Submit(ctx context.Context, build *v1cloudbuild.Build) (string, error)
+	// Get returns the build, with its status and timing filled in.
+	Get(ctx context.Context, buildID string) (*v1cloudbuild.Build, error)
+	// Cancel stops the build if it is still running.
+	Cancel(ctx context.Context, buildID string) error
+	// Log returns what the build's steps have written so far.
+	Log(ctx context.Context, buildID string) (string, error)
+	// List returns the builds with the tag that were created after since,
+	// newest first.
+	List(ctx context.Context, tag string, since time.Time) ([]*v1cloudbuild.Build, error)
+}
+
+// CloudBuild is a Backend that runs builds on Google Container Builder.
+type CloudBuild struct {
+	ProjectID string
+	Builds    *v1cloudbuild.Service
+	Storage   *storage.Client
+}
+
+func (c CloudBuild) Submit(ctx context.Context, build *v1cloudbuild.Build) (string, error) {
+	op, err := c.Builds.Projects.Builds.Create(c.ProjectID, build).Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+	b, err := buildFromOp(op)
+	if err != nil {
+		return "", fmt.Errorf("could not unmarshal build: %v", err)
+	}
+	return b.Id, nil
+}
+
+func buildFromOp(op *v1cloudbuild.Operation) (*v1cloudbuild.Build, error) {
+	md := struct {
+		T     string              `json:"@type"`
+		Build *v1cloudbuild.Build `json:"build"`
+	}{}
+	if err := json.Unmarshal(op.Metadata, &md); err != nil {
+		return nil, err
+	}
+	return md.Build, nil
+}
+
+func (c CloudBuild) Get(ctx context.Context, buildID string) (*v1cloudbuild.Build, error) {
+	return c.Builds.Projects.Builds.Get(c.ProjectID, buildID).Context(ctx).Do()
+}
+
+func (c CloudBuild) Cancel(ctx context.Context, buildID string) error {
+	_, err := c.Builds.Projects.Builds.Cancel(c.ProjectID, buildID, &v1cloudbuild.CancelBuildRequest{}).Context(ctx).Do()
+	return err
+}
+
+func (c CloudBuild) List(ctx context.Context, tag string, since time.Time) ([]*v1cloudbuild.Build, error) {
+	filter := fmt.Sprintf("tags=%q", tag)
+	if !since.IsZero() {
+		filter += fmt.Sprintf(" AND create_time>%q", since.UTC().Format(time.RFC3339))
+	}
+	var builds []*v1cloudbuild.Build
+	if err := c.Builds.Projects.Builds.List(c.ProjectID).Filter(filter).Pages(ctx, func(resp *v1cloudbuild.ListBuildsResponse) error {
+		builds = append(builds, resp.Builds...)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return builds, nil
+}
+
+func (c CloudBuild) Log(ctx context.Context, buildID string) (string, error) {
+	b, err := c.Get(ctx, buildID)
+	if err != nil {
+		return "", err
+	}
+	logfilePath := fmt.Sprintf("%s/log-%s.txt", b.LogsBucket, b.Id)
+	tokens := strings.SplitN(logfilePath[len("gs://"):], "/", 2)
+	bucket := tokens[0]
+	object := tokens[1]
+
+	r, err := c.Storage.Bucket(bucket).Object(object).NewReader(ctx)
+	if err != nil {
+		return "", err
+	}
+	d, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+
+	return string(d), nil
+}
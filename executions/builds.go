@@ -16,12 +16,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"strings"
+	"path/filepath"
+	"time"
 
-	"cloud.google.com/go/storage"
 	"golang.org/x/net/context"
 	v1cloudbuild "google.golang.org/api/cloudbuild/v1"
 	"gopkg.in/yaml.v2"
+
+	"github.com/skelterjohn/flargo/config"
 )
 
 func LoadBuild(path string) (*v1cloudbuild.Build, error) {
@@ -33,45 +35,109 @@ func LoadBuild(path string) (*v1cloudbuild.Build, error) {
 	if err != nil {
 		return nil, fmt.Errorf("could not read config %q: %v", path, err)
 	}
-	b := &v1cloudbuild.Build{}
-	if err := yaml.Unmarshal(edata, b); err != nil {
+	b, err := ParseBuild(edata)
+	if err != nil {
 		return nil, fmt.Errorf("could not parse config %q: %v", path, err)
 	}
 	return b, nil
 }
 
+// ParseBuild reads a build written as YAML.
+func ParseBuild(data []byte) (*v1cloudbuild.Build, error) {
+	b := &v1cloudbuild.Build{}
+	if err := yaml.Unmarshal(data, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// LoadExecutionBuild loads the build an execution runs, from its body in the
+// config or else from its path relative to dir.
+func LoadExecutionBuild(dir string, e config.Execution) (*v1cloudbuild.Build, error) {
+	if e.Body != "" {
+		b, err := ParseBuild([]byte(e.Body))
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %q build: %v", e.Name, err)
+		}
+		return b, nil
+	}
+	return LoadBuild(filepath.Join(dir, e.Path))
+}
+
+// Client gives flargo what it needs from a Backend.
 type Client struct {
-	ProjectID string
-	Builds    *v1cloudbuild.Service
-	Storage   *storage.Client
+	Backend Backend
+}
+
+func (c Client) SubmitBuild(ctx context.Context, build *v1cloudbuild.Build) (string, error) {
+	return c.Backend.Submit(ctx, build)
+}
+
+func (c Client) CancelBuild(ctx context.Context, buildID string) error {
+	return c.Backend.Cancel(ctx, buildID)
 }
 
+// ListBuilds returns the builds with the tag that were created after since,
+// newest first. A zero since lists them all.
+func (c Client) ListBuilds(ctx context.Context, tag string, since time.Time) ([]*v1cloudbuild.Build, error) {
+	return c.Backend.List(ctx, tag, since)
+}
+
+// WaitForBuild polls the build until it is done, and returns an error if it did
+// not succeed.
 func (c Client) WaitForBuild(ctx context.Context, buildID string) error {
-	return nil
+	for {
+		status, err := c.FetchBuildStatus(ctx, buildID)
+		if err != nil {
+			return err
+		}
+		if status == "SUCCESS" {
+			return nil
+		}
+		if BuildFailed(status) {
+			return fmt.Errorf("build %s ended with %s", buildID, status)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
 }
 
-func (c Client) FetchBuildStatus(ctx context.Context, buildID string) (string, error) {
-	return "", nil
+func (c Client) FetchBuild(ctx context.Context, buildID string) (*v1cloudbuild.Build, error) {
+	return c.Backend.Get(ctx, buildID)
 }
 
-func (c Client) FetchBuildLog(ctx context.Context, buildID string) (string, error) {
-	b, err := c.Builds.Projects.Builds.Get(c.ProjectID, buildID).Do()
+func (c Client) FetchBuildStatus(ctx context.Context, buildID string) (string, error) {
+	b, err := c.FetchBuild(ctx, buildID)
 	if err != nil {
 		return "", err
 	}
-	logfilePath := fmt.Sprintf("%s/log-%s.txt", b.LogsBucket, b.Id)
-	tokens := strings.SplitN(logfilePath[len("gs://"):], "/", 2)
-	bucket := tokens[0]
-	object := tokens[1]
+	return b.Status, nil
+}
 
-	r, err := c.Storage.Bucket(bucket).Object(object).NewReader(ctx)
-	if err != nil {
-		return "", err
+// MaxTimeout is the longest cloudbuild lets a build run.
+const MaxTimeout = 24 * time.Hour
+
+// Timeout formats a duration as a build's timeout, up to MaxTimeout.
+func Timeout(d time.Duration) string {
+	if d > MaxTimeout {
+		d = MaxTimeout
 	}
-	d, err := ioutil.ReadAll(r)
-	if err != nil {
-		return "", err
+	return fmt.Sprintf("%ds", int64(d/time.Second))
+}
+
+// BuildFailed is true if the cloudbuild status is one that a build ends in when
+// it did not succeed.
+func BuildFailed(status string) bool {
+	switch status {
+	case "FAILURE", "INTERNAL_ERROR", "TIMEOUT", "CANCELLED":
+		return true
 	}
+	return false
+}
 
-	return string(d), nil
+func (c Client) FetchBuildLog(ctx context.Context, buildID string) (string, error) {
+	return c.Backend.Log(ctx, buildID)
 }
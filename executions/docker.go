@@ -0,0 +1,390 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package executions
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	v1cloudbuild "google.golang.org/api/cloudbuild/v1"
+)
+
+/*
+Docker runs each step of a build with `docker run` on the local machine, so that
+workflows can be tried out without a cloud project.
+
+The wait and complete steps are not run as containers. Docker does their job
+itself, handing artifacts from one build's out directory to the next build's in
+directory, since there is no pubsub or GCS to go through.
+*/
+type Docker struct {
+	// Dir is where each build gets its own /workflow_artifacts directory.
+	Dir string
+	// Source is mounted as /workspace for every step.
+	Source string
+	// ProjectID is substituted for $PROJECT_ID.
+	ProjectID string
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	nextID int
+	builds map[string]*dockerBuild
+	// completed maps the name of each completed execution to its out directory.
+	completed map[string]string
+}
+
+type dockerBuild struct {
+	build  *v1cloudbuild.Build
+	log    bytes.Buffer
+	cancel context.CancelFunc
+	// timedOut is set if the build was cancelled for running past its
+	// timeout.
+	timedOut bool
+}
+
+func NewDocker(dir, source, projectID string) *Docker {
+	d := &Docker{
+		Dir:       dir,
+		Source:    source,
+		ProjectID: projectID,
+		builds:    map[string]*dockerBuild{},
+		completed: map[string]string{},
+	}
+	d.cond = sync.NewCond(&d.mu)
+	return d
+}
+
+func (d *Docker) Submit(ctx context.Context, build *v1cloudbuild.Build) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.nextID++
+	id := fmt.Sprintf("local-%d", d.nextID)
+
+	b := *build
+	b.Id = id
+	b.ProjectId = d.ProjectID
+	b.Status = "QUEUED"
+	b.CreateTime = time.Now().UTC().Format(time.RFC3339)
+
+	// The build outlives the request that submitted it.
+	bctx, cancel := context.WithCancel(context.Background())
+	db := &dockerBuild{
+		build:  &b,
+		cancel: cancel,
+	}
+	d.builds[id] = db
+
+	if timeout, err := time.ParseDuration(b.Timeout); err == nil && timeout > 0 {
+		time.AfterFunc(timeout, func() {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			db.timedOut = true
+			db.cancel()
+			d.cond.Broadcast()
+		})
+	}
+
+	go d.run(bctx, db)
+
+	return id, nil
+}
+
+func (d *Docker) Get(ctx context.Context, buildID string) (*v1cloudbuild.Build, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	db, ok := d.builds[buildID]
+	if !ok {
+		return nil, fmt.Errorf("no build %q", buildID)
+	}
+	b := *db.build
+	return &b, nil
+}
+
+func (d *Docker) Cancel(ctx context.Context, buildID string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	db, ok := d.builds[buildID]
+	if !ok {
+		return fmt.Errorf("no build %q", buildID)
+	}
+	db.cancel()
+	// Wake up a wait step, so that it notices.
+	d.cond.Broadcast()
+	return nil
+}
+
+func (d *Docker) List(ctx context.Context, tag string, since time.Time) ([]*v1cloudbuild.Build, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var builds []*v1cloudbuild.Build
+	// IDs count up, so the newest is last.
+	for i := d.nextID; i > 0; i-- {
+		db := d.builds[fmt.Sprintf("local-%d", i)]
+		created, _ := time.Parse(time.RFC3339, db.build.CreateTime)
+		if !created.After(since) {
+			continue
+		}
+		for _, t := range db.build.Tags {
+			if t == tag {
+				b := *db.build
+				builds = append(builds, &b)
+				break
+			}
+		}
+	}
+	return builds, nil
+}
+
+func (d *Docker) Log(ctx context.Context, buildID string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	db, ok := d.builds[buildID]
+	if !ok {
+		return "", fmt.Errorf("no build %q", buildID)
+	}
+	return db.log.String(), nil
+}
+
+func (d *Docker) setStatus(db *dockerBuild, status string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now().UTC().Format(time.RFC3339)
+	switch status {
+	case "WORKING":
+		db.build.StartTime = now
+	default:
+		db.build.FinishTime = now
+	}
+	db.build.Status = status
+}
+
+// logWriter prefixes each line with the step that wrote it, like cloudbuild.
+type logWriter struct {
+	d      *Docker
+	db     *dockerBuild
+	prefix string
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w.d.mu.Lock()
+	defer w.d.mu.Unlock()
+	s := bufio.NewScanner(bytes.NewReader(p))
+	for s.Scan() {
+		fmt.Fprintf(&w.db.log, "%s: %s\n", w.prefix, s.Text())
+	}
+	return len(p), nil
+}
+
+func (d *Docker) run(ctx context.Context, db *dockerBuild) {
+	d.setStatus(db, "WORKING")
+
+	artifacts := filepath.Join(d.Dir, db.build.Id, "workflow_artifacts")
+	if err := os.MkdirAll(artifacts, 0755); err != nil {
+		fmt.Fprintf(logWriter{d, db, "flargo"}, "could not create artifacts directory: %v", err)
+		d.setStatus(db, "INTERNAL_ERROR")
+		return
+	}
+
+	for i, step := range db.build.Steps {
+		w := logWriter{d, db, fmt.Sprintf("Step #%d", i)}
+		var err error
+		switch step.Name {
+		case WaitImage:
+			err = d.wait(ctx, artifacts, step.Args)
+		case CompleteImage:
+			err = d.complete(artifacts, step.Args)
+		default:
+			err = d.dockerRun(ctx, db.build, i, artifacts, w)
+		}
+		if ctx.Err() != nil {
+			d.mu.Lock()
+			status := "CANCELLED"
+			if db.timedOut {
+				status = "TIMEOUT"
+			}
+			d.mu.Unlock()
+			d.setStatus(db, status)
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(w, "step failed: %v", err)
+			d.setStatus(db, "FAILURE")
+			return
+		}
+	}
+	d.setStatus(db, "SUCCESS")
+}
+
+// wait blocks until the dependencies named in the wait step's arguments have
+// completed, and copies their artifacts in.
+func (d *Docker) wait(ctx context.Context, artifacts string, args []string) error {
+	fs := flag.NewFlagSet("wait", flag.ContinueOnError)
+	completed := fs.String("completed", "", "")
+	// Failures are noticed by whoever is watching the builds, which cancels
+	// whatever they block.
+	fs.String("upstream-failure", "", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 3 {
+		return errors.New("not enough arguments to wait step")
+	}
+	deps := fs.Args()[3:]
+	if *completed != "" {
+		deps = append(deps, strings.Split(*completed, ",")...)
+	}
+
+	for _, dep := range deps {
+		name, alias := dep, dep
+		if tokens := strings.SplitN(dep, ":", 2); len(tokens) == 2 {
+			name, alias = tokens[0], tokens[1]
+		}
+
+		d.mu.Lock()
+		out, ok := d.completed[name]
+		for !ok && ctx.Err() == nil {
+			d.cond.Wait()
+			out, ok = d.completed[name]
+		}
+		d.mu.Unlock()
+		if !ok {
+			return ctx.Err()
+		}
+
+		if err := copyDir(filepath.Join(artifacts, "in", alias), out); err != nil {
+			return fmt.Errorf("could not copy artifacts of %q: %v", name, err)
+		}
+	}
+	return os.MkdirAll(filepath.Join(artifacts, "out"), 0755)
+}
+
+// complete records that the execution named in the complete step's arguments
+// is done, so that waiting builds can go ahead.
+func (d *Docker) complete(artifacts string, args []string) error {
+	if len(args) < 3 {
+		return errors.New("not enough arguments to complete step")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.completed[args[2]] = filepath.Join(artifacts, "out")
+	d.cond.Broadcast()
+	return nil
+}
+
+// Complete records that an execution is done without any build, which is how
+// wait executions and skips are resolved locally.
+func (d *Docker) Complete(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := filepath.Join(d.Dir, "completed", name)
+	os.MkdirAll(out, 0755)
+	d.completed[name] = out
+	d.cond.Broadcast()
+}
+
+func (d *Docker) dockerRun(ctx context.Context, b *v1cloudbuild.Build, i int, artifacts string, w io.Writer) error {
+	step := b.Steps[i]
+
+	// Cancelling the docker command does not stop the container, so it is
+	// named and removed.
+	container := fmt.Sprintf("flargo-%s-%d", b.Id, i)
+	args := []string{
+		"run", "--rm",
+		"--name", container,
+		"-v", d.Source + ":/workspace",
+		"-v", artifacts + ":/workflow_artifacts",
+		"-w", filepath.Join("/workspace", step.Dir),
+	}
+	for _, env := range step.Env {
+		args = append(args, "-e", d.substitute(b, env))
+	}
+	if step.Entrypoint != "" {
+		args = append(args, "--entrypoint", step.Entrypoint)
+	}
+	args = append(args, step.Name)
+	for _, arg := range step.Args {
+		args = append(args, d.substitute(b, arg))
+	}
+
+	cmd := exec.Command("docker", args...)
+	cmd.Stdout = w
+	cmd.Stderr = w
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		exec.Command("docker", "rm", "-f", container).Run()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// substitute fills in the variables cloudbuild would, along with the build's
+// own substitutions.
+func (d *Docker) substitute(b *v1cloudbuild.Build, s string) string {
+	vars := map[string]string{
+		"PROJECT_ID": d.ProjectID,
+		"BUILD_ID":   b.Id,
+	}
+	for k, v := range b.Substitutions {
+		vars[k] = v
+	}
+	return os.Expand(s, func(k string) string {
+		if v, ok := vars[k]; ok {
+			return v
+		}
+		return "$" + k
+	})
+}
+
+// copyDir copies the files under src into dst.
+func copyDir(dst, src string) error {
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, data, info.Mode())
+	})
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package executions
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	v1cloudbuild "google.golang.org/api/cloudbuild/v1"
+)
+
+// The builds in these tests are only wait and complete steps, which Docker
+// runs itself, so they need no docker daemon.
+
+func newTestDocker(t *testing.T) (*Docker, func()) {
+	dir, err := ioutil.TempDir("", "flargo-docker-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewDocker(dir, dir, "local"), func() { os.RemoveAll(dir) }
+}
+
+// waitBuild waits for each of deps, given as EXECUTION:ALIAS, and then
+// completes the named execution.
+func waitBuild(name string, deps ...string) *v1cloudbuild.Build {
+	return &v1cloudbuild.Build{
+		Steps: []*v1cloudbuild.BuildStep{{
+			Name: WaitImage,
+			Args: append([]string{"gs://bucket/local", "local", ""}, deps...),
+		}, {
+			Name: CompleteImage,
+			Args: []string{"gs://bucket/local", "local", name, "$BUILD_ID", "1"},
+		}},
+	}
+}
+
+func submit(ctx context.Context, t *testing.T, d *Docker, b *v1cloudbuild.Build) string {
+	id, err := d.Submit(ctx, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// status gets the build's status, waiting up to ten seconds for it to
+// become want.
+func status(ctx context.Context, t *testing.T, d *Docker, id, want string) string {
+	var b *v1cloudbuild.Build
+	for i := 0; i < 200; i++ {
+		var err error
+		if b, err = d.Get(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+		if b.Status == want {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return b.Status
+}
+
+// blocked reports whether the build is still working a moment from now.
+func blocked(ctx context.Context, t *testing.T, d *Docker, id string) bool {
+	time.Sleep(200 * time.Millisecond)
+	b, err := d.Get(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.Status == "WORKING"
+}
+
+func TestDockerDependencies(t *testing.T) {
+	ctx := context.Background()
+	d, done := newTestDocker(t)
+	defer done()
+
+	test := submit(ctx, t, d, waitBuild("test", "build:bin", "gate:approval"))
+	if !blocked(ctx, t, d, test) {
+		t.Fatalf("test is not waiting for its dependencies")
+	}
+	build := submit(ctx, t, d, waitBuild("build"))
+	if got := status(ctx, t, d, build, "SUCCESS"); got != "SUCCESS" {
+		t.Fatalf("build is %s, want SUCCESS", got)
+	}
+	if !blocked(ctx, t, d, test) {
+		t.Fatalf("test is not waiting for gate")
+	}
+
+	// gate completes without a build, with what its out directory has.
+	out := filepath.Join(d.Dir, "completed", "gate")
+	if err := os.MkdirAll(out, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(out, "approved.txt"), []byte("yes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d.Complete("gate")
+	if got := status(ctx, t, d, test, "SUCCESS"); got != "SUCCESS" {
+		t.Fatalf("test is %s, want SUCCESS", got)
+	}
+
+	in := filepath.Join(d.Dir, test, "workflow_artifacts", "in")
+	if data, err := ioutil.ReadFile(filepath.Join(in, "approval", "approved.txt")); err != nil || string(data) != "yes" {
+		t.Errorf("got gate's artifact %q, %v, want yes", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(in, "bin")); err != nil {
+		t.Errorf("build's artifacts are not in bin: %v", err)
+	}
+}
+
+func TestDockerCancel(t *testing.T) {
+	ctx := context.Background()
+	d, done := newTestDocker(t)
+	defer done()
+
+	id := submit(ctx, t, d, waitBuild("test", "never"))
+	if !blocked(ctx, t, d, id) {
+		t.Fatalf("test is not waiting for never")
+	}
+	if err := d.Cancel(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if got := status(ctx, t, d, id, "CANCELLED"); got != "CANCELLED" {
+		t.Errorf("test is %s after it was cancelled, want CANCELLED", got)
+	}
+	if err := d.Cancel(ctx, "local-100"); err == nil {
+		t.Errorf("cancelled a build that does not exist")
+	}
+}
+
+func TestDockerTimeout(t *testing.T) {
+	ctx := context.Background()
+	d, done := newTestDocker(t)
+	defer done()
+
+	b := waitBuild("test", "never")
+	b.Timeout = "1s"
+	id := submit(ctx, t, d, b)
+	if got := status(ctx, t, d, id, "TIMEOUT"); got != "TIMEOUT" {
+		t.Errorf("test is %s after its timeout, want TIMEOUT", got)
+	}
+}
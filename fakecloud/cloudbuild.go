@@ -0,0 +1,301 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fakecloud
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	v1cloudbuild "google.golang.org/api/cloudbuild/v1"
+)
+
+// A Step is one step of a build, as handed to the StepFunc for its image.
+type Step struct {
+	// Build is the build the step is part of.
+	Build *v1cloudbuild.Build
+	// Index is the step's place in the build.
+	Index int
+	// Args are the step's arguments, with substitutions made.
+	Args []string
+	// Volumes maps the path each of the step's volumes is mounted at to a
+	// local directory, which is shared by every step in the build.
+	Volumes map[string]string
+	// Log ends up in the build log, prefixed like cloudbuild does.
+	Log io.Writer
+}
+
+// A StepFunc does what a step's image would. If it returns an error, the build
+// fails.
+type StepFunc func(ctx context.Context, s *Step) error
+
+// HandleImage has f run every step that uses the image.
+func (c *Cloud) HandleImage(image string, f StepFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.steps[image] = f
+}
+
+type build struct {
+	build  *v1cloudbuild.Build
+	log    bytes.Buffer
+	cancel context.CancelFunc
+}
+
+// LogsBucket is where the fake keeps the logs for a project's builds.
+func LogsBucket(projectID string) string {
+	return fmt.Sprintf("%s.cloudbuild-logs.googleusercontent.com", projectID)
+}
+
+// Build returns a copy of the build, or nil if there is no such build.
+func (c *Cloud) Build(buildID string) *v1cloudbuild.Build {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.builds[buildID]
+	if !ok {
+		return nil
+	}
+	cp := *b.build
+	return &cp
+}
+
+func (c *Cloud) serveBuilds(w http.ResponseWriter, r *http.Request, tokens []string) {
+	projectID := tokens[0]
+	if len(tokens) == 2 {
+		if r.Method == "GET" {
+			c.listBuilds(w, projectID, r.URL.Query().Get("filter"))
+			return
+		}
+		if r.Method != "POST" {
+			writeError(w, http.StatusMethodNotAllowed, "cannot %s builds", r.Method)
+			return
+		}
+		var b v1cloudbuild.Build
+		if !readJSON(w, r, &b) {
+			return
+		}
+		c.submit(projectID, &b)
+		writeJSON(w, map[string]interface{}{
+			"name": fmt.Sprintf("operations/build/%s/%s", projectID, b.Id),
+			"metadata": map[string]interface{}{
+				"@type": "type.googleapis.com/google.devtools.cloudbuild.v1.BuildOperationMetadata",
+				"build": &b,
+			},
+		})
+		return
+	}
+
+	buildID := tokens[2]
+	cancel := false
+	if strings.HasSuffix(buildID, ":cancel") {
+		buildID = strings.TrimSuffix(buildID, ":cancel")
+		cancel = true
+	}
+	// Like cloudbuild, the fake rejects what could not be one of its IDs.
+	if !strings.HasPrefix(buildID, "build-") {
+		writeError(w, http.StatusBadRequest, "invalid build ID %q", buildID)
+		return
+	}
+	b := c.Build(buildID)
+	if b == nil || b.ProjectId != projectID {
+		writeError(w, http.StatusNotFound, "no build %q", buildID)
+		return
+	}
+	if cancel {
+		c.mu.Lock()
+		c.builds[buildID].cancel()
+		c.mu.Unlock()
+	}
+	writeJSON(w, b)
+}
+
+// listBuilds sends the project's builds that match the filter, newest first,
+// all in one page. The only filters the fake understands are those flargo
+// uses: tags="TAG" and create_time>"TIME", joined by AND.
+func (c *Cloud) listBuilds(w http.ResponseWriter, projectID, filter string) {
+	var tag string
+	var since time.Time
+	for _, clause := range strings.Split(filter, " AND ") {
+		switch {
+		case clause == "":
+		case strings.HasPrefix(clause, "tags="):
+			tag = strings.Trim(strings.TrimPrefix(clause, "tags="), `"`)
+		case strings.HasPrefix(clause, "create_time>"):
+			t, err := time.Parse(time.RFC3339, strings.Trim(strings.TrimPrefix(clause, "create_time>"), `"`))
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid time in %q", clause)
+				return
+			}
+			since = t
+		default:
+			writeError(w, http.StatusBadRequest, "the fake cannot filter by %q", clause)
+			return
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var builds []*v1cloudbuild.Build
+	for i := c.nextBuild; i > 0; i-- {
+		fb, ok := c.builds[fmt.Sprintf("build-%d", i)]
+		if !ok || fb.build.ProjectId != projectID {
+			continue
+		}
+		if created, _ := time.Parse(time.RFC3339Nano, fb.build.CreateTime); !created.After(since) {
+			continue
+		}
+		tagged := tag == ""
+		for _, t := range fb.build.Tags {
+			tagged = tagged || t == tag
+		}
+		if tagged {
+			cp := *fb.build
+			builds = append(builds, &cp)
+		}
+	}
+	writeJSON(w, &v1cloudbuild.ListBuildsResponse{
+		Builds: builds,
+	})
+}
+
+// submit fills in the build's ID and status, and starts running it.
+func (c *Cloud) submit(projectID string, b *v1cloudbuild.Build) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.nextBuild++
+	b.Id = fmt.Sprintf("build-%d", c.nextBuild)
+	b.ProjectId = projectID
+	b.Status = "QUEUED"
+	b.CreateTime = time.Now().UTC().Format(time.RFC3339Nano)
+	b.LogsBucket = "gs://" + LogsBucket(projectID)
+
+	bctx, cancel := context.WithCancel(c.ctx)
+	cp := *b
+	fb := &build{
+		build:  &cp,
+		cancel: cancel,
+	}
+	c.builds[b.Id] = fb
+	if c.buckets[LogsBucket(projectID)] == nil {
+		c.buckets[LogsBucket(projectID)] = newBucket(projectID)
+	}
+
+	go c.run(bctx, fb)
+}
+
+func (c *Cloud) setStatus(fb *build, status string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	switch status {
+	case "WORKING":
+		fb.build.StartTime = now
+	default:
+		fb.build.FinishTime = now
+	}
+	fb.build.Status = status
+}
+
+// logWriter prefixes each line with the step that wrote it, and keeps the log
+// object in the logs bucket up to date.
+type logWriter struct {
+	c      *Cloud
+	fb     *build
+	prefix string
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w.c.mu.Lock()
+	defer w.c.mu.Unlock()
+	s := bufio.NewScanner(bytes.NewReader(p))
+	for s.Scan() {
+		fmt.Fprintf(&w.fb.log, "%s: %s\n", w.prefix, s.Text())
+	}
+	b := w.fb.build
+	w.c.buckets[LogsBucket(b.ProjectId)].put(fmt.Sprintf("log-%s.txt", b.Id), w.fb.log.Bytes())
+	return len(p), nil
+}
+
+func (c *Cloud) run(ctx context.Context, fb *build) {
+	c.setStatus(fb, "WORKING")
+
+	for i, bs := range fb.build.Steps {
+		w := logWriter{c, fb, fmt.Sprintf("Step #%d", i)}
+
+		c.mu.Lock()
+		f, ok := c.steps[bs.Name]
+		c.mu.Unlock()
+		if !ok {
+			fmt.Fprintf(w, "no fake for image %q", bs.Name)
+			c.setStatus(fb, "FAILURE")
+			return
+		}
+
+		s := &Step{
+			Build:   c.Build(fb.build.Id),
+			Index:   i,
+			Volumes: map[string]string{},
+			Log:     w,
+		}
+		for _, arg := range bs.Args {
+			s.Args = append(s.Args, substitute(fb.build, arg))
+		}
+		for _, v := range bs.Volumes {
+			dir := filepath.Join(c.Dir, fb.build.Id, v.Name)
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				fmt.Fprintf(w, "could not create volume %q: %v", v.Name, err)
+				c.setStatus(fb, "INTERNAL_ERROR")
+				return
+			}
+			s.Volumes[v.Path] = dir
+		}
+
+		err := f(ctx, s)
+		if ctx.Err() != nil {
+			c.setStatus(fb, "CANCELLED")
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(w, "step failed: %v", err)
+			c.setStatus(fb, "FAILURE")
+			return
+		}
+	}
+	c.setStatus(fb, "SUCCESS")
+}
+
+// substitute fills in the variables cloudbuild would, along with the build's
+// own substitutions.
+func substitute(b *v1cloudbuild.Build, s string) string {
+	vars := map[string]string{
+		"PROJECT_ID": b.ProjectId,
+		"BUILD_ID":   b.Id,
+	}
+	for k, v := range b.Substitutions {
+		vars[k] = v
+	}
+	return os.Expand(s, func(k string) string {
+		if v, ok := vars[k]; ok {
+			return v
+		}
+		return "$" + k
+	})
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fakecloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	v1cloudbuild "google.golang.org/api/cloudbuild/v1"
+	"google.golang.org/api/option"
+	v1pubsub "google.golang.org/api/pubsub/v1"
+)
+
+/*
+The fakecloud package serves in-memory versions of the parts of cloudbuild,
+pubsub and GCS that flargo uses, on localhost, so that the generated clients can
+be pointed at them and a whole workflow can run inside a test.
+
+Builds are run by the fake itself. Each step is handed to the StepFunc
+registered for its image, since there is no docker to run it with.
+*/
+type Cloud struct {
+	// URL is where the fake is served.
+	URL string
+	// Dir is where each build gets a local directory for each of its volumes.
+	Dir string
+
+	server *httptest.Server
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// ctx is cancelled when the cloud is closed, which stops any builds.
+	ctx    context.Context
+	cancel context.CancelFunc
+	steps  map[string]StepFunc
+
+	nextBuild int
+	builds    map[string]*build
+
+	nextMessage   int
+	topics        map[string]bool
+	subscriptions map[string]*subscription
+
+	buckets map[string]*bucket
+}
+
+// New starts serving a cloud with nothing in it.
+func New() (*Cloud, error) {
+	dir, err := ioutil.TempDir("", "fakecloud-")
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Cloud{
+		Dir:           dir,
+		ctx:           ctx,
+		cancel:        cancel,
+		steps:         map[string]StepFunc{},
+		builds:        map[string]*build{},
+		topics:        map[string]bool{},
+		subscriptions: map[string]*subscription{},
+		buckets:       map[string]*bucket{},
+	}
+	c.cond = sync.NewCond(&c.mu)
+	c.server = httptest.NewServer(c)
+	c.URL = c.server.URL
+	return c, nil
+}
+
+// Close stops every build, and the server.
+func (c *Cloud) Close() {
+	c.cancel()
+	c.mu.Lock()
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	c.server.Close()
+	os.RemoveAll(c.Dir)
+}
+
+// Cloudbuild is a cloudbuild client that talks to the fake.
+func (c *Cloud) Cloudbuild() *v1cloudbuild.Service {
+	cb, _ := v1cloudbuild.New(http.DefaultClient)
+	cb.BasePath = c.URL + "/"
+	return cb
+}
+
+// PubSub is a pubsub client that talks to the fake.
+func (c *Cloud) PubSub() *v1pubsub.Service {
+	ps, _ := v1pubsub.New(http.DefaultClient)
+	ps.BasePath = c.URL + "/"
+	return ps
+}
+
+// Storage is a GCS client that talks to the fake.
+func (c *Cloud) Storage(ctx context.Context) (*storage.Client, error) {
+	return storage.NewClient(ctx, option.WithEndpoint(c.URL+"/storage/v1/"), option.WithoutAuthentication())
+}
+
+func (c *Cloud) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := r.URL.Path
+	switch {
+	case strings.HasPrefix(p, "/upload/storage/v1/"):
+		c.serveUpload(w, r, strings.TrimPrefix(p, "/upload/storage/v1/"))
+	case strings.HasPrefix(p, "/storage/v1/"):
+		c.serveStorage(w, r, strings.TrimPrefix(p, "/storage/v1/"))
+	case strings.HasPrefix(p, "/v1/projects/"):
+		tokens := strings.SplitN(strings.TrimPrefix(p, "/v1/projects/"), "/", 3)
+		if len(tokens) < 2 {
+			writeError(w, http.StatusNotFound, "no such resource %q", p)
+			return
+		}
+		collection := tokens[1]
+		if i := strings.Index(collection, ":"); i != -1 {
+			collection = collection[:i]
+		}
+		switch collection {
+		case "builds":
+			c.serveBuilds(w, r, tokens)
+		case "topics":
+			c.serveTopics(w, r, p[len("/v1/"):])
+		case "subscriptions":
+			c.serveSubscriptions(w, r, p[len("/v1/"):])
+		default:
+			writeError(w, http.StatusNotFound, "no such resource %q", p)
+		}
+	default:
+		// GCS reads come straight to /bucket/object.
+		c.serveRead(w, r, strings.TrimPrefix(p, "/"))
+	}
+}
+
+// writeJSON sends v as the response, the way every API here does.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError sends an error that the generated clients turn into a
+// *googleapi.Error with the given code.
+func writeError(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": fmt.Sprintf(format, args...),
+		},
+	})
+}
+
+// readJSON decodes the request body into v, and reports whether it could.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, "could not decode request: %v", err)
+		return false
+	}
+	return true
+}
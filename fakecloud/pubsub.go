@@ -0,0 +1,335 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fakecloud
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	v1pubsub "google.golang.org/api/pubsub/v1"
+)
+
+// pullWait is how long a pull waits for a message before coming back empty, so
+// that callers polling the fake do not spin.
+const pullWait = 100 * time.Millisecond
+
+// A subscription holds the messages published to its topic since it was
+// created. Messages that are pulled are not delivered again, even if they are
+// never acknowledged.
+type subscription struct {
+	topic   string
+	pending []*v1pubsub.PubsubMessage
+	nextAck int
+}
+
+// Topics lists the full names of the topics that exist.
+func (c *Cloud) Topics() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var names []string
+	for name := range c.topics {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Subscriptions lists the full names of the subscriptions that exist.
+func (c *Cloud) Subscriptions() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var names []string
+	for name := range c.subscriptions {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (c *Cloud) serveTopics(w http.ResponseWriter, r *http.Request, name string) {
+	if strings.HasSuffix(name, ":publish") {
+		name = strings.TrimSuffix(name, ":publish")
+		var req v1pubsub.PublishRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		ids, ok := c.publish(name, req.Messages)
+		if !ok {
+			writeError(w, http.StatusNotFound, "no topic %q", name)
+			return
+		}
+		writeJSON(w, &v1pubsub.PublishResponse{
+			MessageIds: ids,
+		})
+		return
+	}
+	if strings.HasSuffix(name, "/subscriptions") {
+		c.listSubscriptions(w, r, strings.TrimSuffix(name, "/subscriptions"))
+		return
+	}
+	if strings.HasSuffix(name, "/topics") {
+		c.listTopics(w, r, strings.TrimSuffix(name, "/topics"))
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch r.Method {
+	case "PUT":
+		if c.topics[name] {
+			writeError(w, http.StatusConflict, "topic %q already exists", name)
+			return
+		}
+		c.topics[name] = true
+		writeJSON(w, &v1pubsub.Topic{
+			Name: name,
+		})
+	case "GET":
+		if !c.topics[name] {
+			writeError(w, http.StatusNotFound, "no topic %q", name)
+			return
+		}
+		writeJSON(w, &v1pubsub.Topic{
+			Name: name,
+		})
+	case "DELETE":
+		if !c.topics[name] {
+			writeError(w, http.StatusNotFound, "no topic %q", name)
+			return
+		}
+		delete(c.topics, name)
+		// Its subscriptions are left behind, like they are by pubsub.
+		for _, s := range c.subscriptions {
+			if s.topic == name {
+				s.topic = deletedTopic
+			}
+		}
+		writeJSON(w, &v1pubsub.Empty{})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "cannot %s a topic", r.Method)
+	}
+}
+
+// deletedTopic is the topic of a subscription whose topic has been deleted.
+const deletedTopic = "_deleted-topic_"
+
+// listTopics sends every topic in the project, all in one page.
+func (c *Cloud) listTopics(w http.ResponseWriter, r *http.Request, project string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var names []string
+	for name := range c.topics {
+		if strings.HasPrefix(name, project+"/topics/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var topics []*v1pubsub.Topic
+	for _, name := range names {
+		topics = append(topics, &v1pubsub.Topic{
+			Name: name,
+		})
+	}
+	writeJSON(w, &v1pubsub.ListTopicsResponse{
+		Topics: topics,
+	})
+}
+
+// listSubscriptions sends the names of the topic's subscriptions, all in one
+// page.
+func (c *Cloud) listSubscriptions(w http.ResponseWriter, r *http.Request, topic string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.topics[topic] {
+		writeError(w, http.StatusNotFound, "no topic %q", topic)
+		return
+	}
+	var names []string
+	for name, s := range c.subscriptions {
+		if s.topic == topic {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	writeJSON(w, &v1pubsub.ListTopicSubscriptionsResponse{
+		Subscriptions: names,
+	})
+}
+
+// publish hands the messages to every subscription on the topic, and returns
+// their IDs.
+func (c *Cloud) publish(topic string, msgs []*v1pubsub.PubsubMessage) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.topics[topic] {
+		return nil, false
+	}
+	var ids []string
+	for _, m := range msgs {
+		c.nextMessage++
+		id := fmt.Sprint(c.nextMessage)
+		ids = append(ids, id)
+		for _, s := range c.subscriptions {
+			if s.topic != topic {
+				continue
+			}
+			s.pending = append(s.pending, &v1pubsub.PubsubMessage{
+				Data:        m.Data,
+				Attributes:  m.Attributes,
+				MessageId:   id,
+				PublishTime: time.Now().UTC().Format(time.RFC3339Nano),
+			})
+		}
+	}
+	c.cond.Broadcast()
+	return ids, true
+}
+
+func (c *Cloud) serveSubscriptions(w http.ResponseWriter, r *http.Request, name string) {
+	switch {
+	case strings.HasSuffix(name, ":pull"):
+		var req v1pubsub.PullRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		msgs, ok := c.pull(strings.TrimSuffix(name, ":pull"), int(req.MaxMessages))
+		if !ok {
+			writeError(w, http.StatusNotFound, "no subscription %q", name)
+			return
+		}
+		writeJSON(w, &v1pubsub.PullResponse{
+			ReceivedMessages: msgs,
+		})
+		return
+	case strings.HasSuffix(name, ":acknowledge"):
+		// Pulled messages are already gone.
+		writeJSON(w, &v1pubsub.Empty{})
+		return
+	case strings.HasSuffix(name, "/subscriptions"):
+		c.listProjectSubscriptions(w, r, strings.TrimSuffix(name, "/subscriptions"))
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch r.Method {
+	case "PUT":
+		var sub v1pubsub.Subscription
+		if !readJSON(w, r, &sub) {
+			return
+		}
+		if _, ok := c.subscriptions[name]; ok {
+			writeError(w, http.StatusConflict, "subscription %q already exists", name)
+			return
+		}
+		if !c.topics[sub.Topic] {
+			writeError(w, http.StatusNotFound, "no topic %q", sub.Topic)
+			return
+		}
+		c.subscriptions[name] = &subscription{
+			topic: sub.Topic,
+		}
+		writeJSON(w, &v1pubsub.Subscription{
+			Name:  name,
+			Topic: sub.Topic,
+		})
+	case "GET":
+		s, ok := c.subscriptions[name]
+		if !ok {
+			writeError(w, http.StatusNotFound, "no subscription %q", name)
+			return
+		}
+		writeJSON(w, &v1pubsub.Subscription{
+			Name:  name,
+			Topic: s.topic,
+		})
+	case "DELETE":
+		if _, ok := c.subscriptions[name]; !ok {
+			writeError(w, http.StatusNotFound, "no subscription %q", name)
+			return
+		}
+		delete(c.subscriptions, name)
+		writeJSON(w, &v1pubsub.Empty{})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "cannot %s a subscription", r.Method)
+	}
+}
+
+// listProjectSubscriptions sends every subscription in the project, all in one
+// page.
+func (c *Cloud) listProjectSubscriptions(w http.ResponseWriter, r *http.Request, project string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var names []string
+	for name := range c.subscriptions {
+		if strings.HasPrefix(name, project+"/subscriptions/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var subscriptions []*v1pubsub.Subscription
+	for _, name := range names {
+		subscriptions = append(subscriptions, &v1pubsub.Subscription{
+			Name:  name,
+			Topic: c.subscriptions[name].topic,
+		})
+	}
+	writeJSON(w, &v1pubsub.ListSubscriptionsResponse{
+		Subscriptions: subscriptions,
+	})
+}
+
+// pull takes up to max messages from the subscription, waiting a little while
+// for one to arrive if there are none.
+func (c *Cloud) pull(name string, max int) ([]*v1pubsub.ReceivedMessage, bool) {
+	if max <= 0 {
+		max = 1
+	}
+	timer := time.AfterFunc(pullWait, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.cond.Broadcast()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(pullWait)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		s, ok := c.subscriptions[name]
+		if !ok {
+			return nil, false
+		}
+		if len(s.pending) != 0 || !time.Now().Before(deadline) || c.ctx.Err() != nil {
+			break
+		}
+		c.cond.Wait()
+	}
+
+	s := c.subscriptions[name]
+	n := len(s.pending)
+	if n > max {
+		n = max
+	}
+	var msgs []*v1pubsub.ReceivedMessage
+	for _, m := range s.pending[:n] {
+		s.nextAck++
+		msgs = append(msgs, &v1pubsub.ReceivedMessage{
+			AckId:   fmt.Sprintf("%s-%d", name, s.nextAck),
+			Message: m,
+		})
+	}
+	s.pending = s.pending[n:]
+	return msgs, true
+}
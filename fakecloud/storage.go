@@ -0,0 +1,297 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fakecloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+type object struct {
+	data    []byte
+	created time.Time
+}
+
+type bucket struct {
+	projectID string
+	created   time.Time
+	objects   map[string]*object
+}
+
+func newBucket(projectID string) *bucket {
+	return &bucket{
+		projectID: projectID,
+		created:   time.Now(),
+		objects:   map[string]*object{},
+	}
+}
+
+func (b *bucket) put(name string, data []byte) *object {
+	o := &object{
+		data:    append([]byte(nil), data...),
+		created: time.Now(),
+	}
+	b.objects[name] = o
+	return o
+}
+
+// Object returns the contents of an object, and whether it exists.
+func (c *Cloud) Object(bucket, name string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.buckets[bucket]
+	if !ok {
+		return nil, false
+	}
+	o, ok := b.objects[name]
+	if !ok {
+		return nil, false
+	}
+	return o.data, true
+}
+
+// Objects lists the names of the objects in a bucket that begin with prefix.
+func (c *Cloud) Objects(bucket, prefix string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.buckets[bucket]
+	if !ok {
+		return nil
+	}
+	return b.list(prefix)
+}
+
+func (b *bucket) list(prefix string) []string {
+	var names []string
+	for name := range b.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func objectResource(bucket, name string, o *object) map[string]interface{} {
+	return map[string]interface{}{
+		"kind":        "storage#object",
+		"bucket":      bucket,
+		"name":        name,
+		"size":        fmt.Sprint(len(o.data)),
+		"generation":  fmt.Sprint(o.created.UnixNano()),
+		"timeCreated": o.created.UTC().Format(time.RFC3339Nano),
+		"updated":     o.created.UTC().Format(time.RFC3339Nano),
+	}
+}
+
+func bucketResource(name string, b *bucket) map[string]interface{} {
+	return map[string]interface{}{
+		"kind":        "storage#bucket",
+		"name":        name,
+		"timeCreated": b.created.UTC().Format(time.RFC3339Nano),
+	}
+}
+
+// serveStorage handles the JSON API, under /storage/v1/.
+func (c *Cloud) serveStorage(w http.ResponseWriter, r *http.Request, p string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if p == "b" {
+		if r.Method != "POST" {
+			writeError(w, http.StatusMethodNotAllowed, "cannot %s buckets", r.Method)
+			return
+		}
+		var req struct {
+			Name string `json:"name"`
+		}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if _, ok := c.buckets[req.Name]; ok {
+			writeError(w, http.StatusConflict, "bucket %q already exists", req.Name)
+			return
+		}
+		b := newBucket(r.URL.Query().Get("project"))
+		c.buckets[req.Name] = b
+		writeJSON(w, bucketResource(req.Name, b))
+		return
+	}
+
+	// b/BUCKET[/iam | /o[/OBJECT]]
+	tokens := strings.SplitN(p, "/", 4)
+	if len(tokens) < 2 || tokens[0] != "b" {
+		writeError(w, http.StatusNotFound, "no such resource %q", p)
+		return
+	}
+	bname := tokens[1]
+	b, ok := c.buckets[bname]
+	if !ok {
+		writeError(w, http.StatusNotFound, "no bucket %q", bname)
+		return
+	}
+
+	switch {
+	case len(tokens) == 2:
+		switch r.Method {
+		case "GET":
+			writeJSON(w, bucketResource(bname, b))
+		case "DELETE":
+			if len(b.objects) != 0 {
+				writeError(w, http.StatusConflict, "bucket %q is not empty", bname)
+				return
+			}
+			delete(c.buckets, bname)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "cannot %s a bucket", r.Method)
+		}
+	case len(tokens) == 3 && tokens[2] == "iam":
+		// The project owns its buckets, as it does by default.
+		writeJSON(w, map[string]interface{}{
+			"kind": "storage#policy",
+			"bindings": []map[string]interface{}{{
+				"role":    "roles/storage.legacyBucketOwner",
+				"members": []string{"projectOwner:" + b.projectID},
+			}},
+		})
+	case len(tokens) == 3 && tokens[2] == "o":
+		// With a delimiter, names that go on past it after the prefix are
+		// listed once as a prefix, like directories.
+		prefix, delim := r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter")
+		var items []map[string]interface{}
+		var prefixes []string
+		for _, name := range b.list(prefix) {
+			if i := strings.Index(name[len(prefix):], delim); delim != "" && i != -1 {
+				dir := name[:len(prefix)+i+len(delim)]
+				if len(prefixes) == 0 || prefixes[len(prefixes)-1] != dir {
+					prefixes = append(prefixes, dir)
+				}
+				continue
+			}
+			items = append(items, objectResource(bname, name, b.objects[name]))
+		}
+		writeJSON(w, map[string]interface{}{
+			"kind":     "storage#objects",
+			"items":    items,
+			"prefixes": prefixes,
+		})
+	case len(tokens) == 4 && tokens[2] == "o":
+		name := tokens[3]
+		o, ok := b.objects[name]
+		if !ok {
+			writeError(w, http.StatusNotFound, "no object %q in %q", name, bname)
+			return
+		}
+		switch {
+		case r.Method == "DELETE":
+			delete(b.objects, name)
+			w.WriteHeader(http.StatusNoContent)
+		case r.URL.Query().Get("alt") == "media":
+			w.Write(o.data)
+		default:
+			writeJSON(w, objectResource(bname, name, o))
+		}
+	default:
+		writeError(w, http.StatusNotFound, "no such resource %q", p)
+	}
+}
+
+// serveUpload handles simple and multipart uploads, under /upload/storage/v1/.
+func (c *Cloud) serveUpload(w http.ResponseWriter, r *http.Request, p string) {
+	// b/BUCKET/o
+	tokens := strings.Split(p, "/")
+	if len(tokens) != 3 || tokens[0] != "b" || tokens[2] != "o" {
+		writeError(w, http.StatusNotFound, "no such resource %q", p)
+		return
+	}
+	bname := tokens[1]
+
+	name := r.URL.Query().Get("name")
+	var data []byte
+	var err error
+	switch r.URL.Query().Get("uploadType") {
+	case "media":
+		data, err = ioutil.ReadAll(r.Body)
+	case "multipart":
+		name, data, err = readMultipart(r)
+	default:
+		writeError(w, http.StatusBadRequest, "unsupported upload type %q", r.URL.Query().Get("uploadType"))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "could not read upload: %v", err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.buckets[bname]
+	if !ok {
+		writeError(w, http.StatusNotFound, "no bucket %q", bname)
+		return
+	}
+	writeJSON(w, objectResource(bname, name, b.put(name, data)))
+}
+
+// readMultipart reads an upload whose first part is the object's metadata and
+// whose second is its contents.
+func readMultipart(r *http.Request) (string, []byte, error) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return "", nil, err
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	part, err := mr.NextPart()
+	if err != nil {
+		return "", nil, err
+	}
+	var md struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(part).Decode(&md); err != nil {
+		return "", nil, err
+	}
+	part, err = mr.NextPart()
+	if err != nil {
+		return "", nil, err
+	}
+	data, err := ioutil.ReadAll(part)
+	return md.Name, data, err
+}
+
+// serveRead handles reads through the XML API, which are at /BUCKET/OBJECT.
+func (c *Cloud) serveRead(w http.ResponseWriter, r *http.Request, p string) {
+	tokens := strings.SplitN(p, "/", 2)
+	if len(tokens) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	data, ok := c.Object(tokens[0], tokens[1])
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+	if r.Method == "HEAD" {
+		return
+	}
+	w.Write(data)
+}
@@ -17,8 +17,11 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -33,16 +36,22 @@ import (
 	"github.com/skelterjohn/flargo/auth"
 	"github.com/skelterjohn/flargo/config"
 	"github.com/skelterjohn/flargo/executions"
+	"github.com/skelterjohn/flargo/workflow"
 )
 
 func usage() {
 	log.Fatal(`flargo is a tool to run workflows on top of Google Container Engine.
 
-Usage: flargo start CONFIG
+Usage: flargo start [--upstream-failure=park|fail] [--scheduling=eager|lazy] [--timeout=DURATION] [--bootstrap-timeout=DURATION] CONFIG [--param=KEY=VALUE]*
+              local CONFIG [--param=KEY=VALUE]*
               wait FLOW
-              describe FLOW
-              retry FLOW EXECUTION
-              skip FLOW EXECUTION
+              describe [--format=table|json] FLOW
+              retry [--force] FLOW EXECUTION
+              skip FLOW EXECUTION [ARTIFACTS_DIR]
+              approve [--comment=TEXT] FLOW EXECUTION
+              cancel FLOW
+              gc [--older-than=AGE] [--artifact-retention=AGE] [--dry-run]
+              list [--status=running|succeeded|failed|cancelled] [--since=AGE] [--until=AGE] [--format=table|json]
 `)
 }
 
@@ -58,165 +67,459 @@ func main() {
 	}
 	switch args[0] {
 	case "start":
-		if len(args) != 2 {
+		fs := flag.NewFlagSet("start", flag.ExitOnError)
+		upstreamFailure := fs.String("upstream-failure", "park", "what an execution does when a dependency fails: park until it is retried or skipped, or fail")
+		scheduling := fs.String("scheduling", "eager", "when builds are created: eager, all at once by flargo, or lazy, by coord as their dependencies complete")
+		timeout := fs.Duration("timeout", 0, "how long the workflow may run before what is left of it is cancelled, up to 24h")
+		bootstrapTimeout := fs.Duration("bootstrap-timeout", workflow.DefaultBootstrapTimeout, "how long to wait for coord to start")
+		params := paramFlag{}
+		fs.Var(params, "param", "a value for one of the config's params, as KEY=VALUE")
+		parseAround(fs, args[1:])
+		if fs.NArg() != 1 {
 			usage()
 		}
-		cfgFile := args[1]
-		cfg, err := config.Load(cfgFile)
+		if *timeout < 0 || *timeout >= executions.MaxTimeout {
+			log.Fatalf("The timeout must be less than %s", executions.MaxTimeout)
+		}
+		policy, err := workflow.ParseUpstreamFailure(*upstreamFailure)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sched, err := workflow.ParseScheduling(*scheduling)
+		if err != nil {
+			log.Fatal(err)
+		}
+		e, err := newEnv(ctx)
+		if err != nil {
+			log.Fatalf("Could not set up: %v", err)
+		}
+		cfgFile := fs.Arg(0)
+		cfg, err := config.LoadFrom(cfgFile, e.openConfig)
 		if err != nil {
 			log.Fatalf("Could not parse %q: %v", cfgFile, err)
 		}
-		if err := start(ctx, cfg); err != nil {
+		opts := workflow.Options{
+			UpstreamFailure:  policy,
+			Scheduling:       sched,
+			Params:           params,
+			Timeout:          *timeout,
+			BootstrapTimeout: *bootstrapTimeout,
+		}
+		if _, err := start(ctx, e, cfg, opts); err != nil {
 			log.Fatalf("Could not start workflow: %v", err)
 		}
+	case "local":
+		fs := flag.NewFlagSet("local", flag.ExitOnError)
+		params := paramFlag{}
+		fs.Var(params, "param", "a value for one of the config's params, as KEY=VALUE")
+		parseAround(fs, args[1:])
+		if fs.NArg() != 1 {
+			usage()
+		}
+		// Nothing else needs credentials, so there are none until a config
+		// in GCS calls for them.
+		e := &env{}
+		cfgFile := fs.Arg(0)
+		cfg, err := config.LoadFrom(cfgFile, e.openConfig)
+		if err != nil {
+			log.Fatalf("Could not parse %q: %v", cfgFile, err)
+		}
+		if err := runLocal(ctx, cfg, params); err != nil {
+			log.Fatalf("Workflow did not succeed: %v", err)
+		}
+	case "wait":
+		if len(args) != 2 {
+			usage()
+		}
+		e, err := newEnv(ctx)
+		if err != nil {
+			log.Fatalf("Could not set up: %v", err)
+		}
+		if err := waitWorkflow(ctx, e, args[1]); err != nil {
+			log.Fatalf("Workflow did not succeed: %v", err)
+		}
+	case "describe":
+		fs := flag.NewFlagSet("describe", flag.ExitOnError)
+		format := fs.String("format", "table", "output format, table or json")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			usage()
+		}
+		e, err := newEnv(ctx)
+		if err != nil {
+			log.Fatalf("Could not set up: %v", err)
+		}
+		if err := describe(ctx, e, fs.Arg(0), *format, os.Stdout); err != nil {
+			log.Fatalf("Could not describe workflow: %v", err)
+		}
+	case "retry":
+		fs := flag.NewFlagSet("retry", flag.ExitOnError)
+		force := fs.Bool("force", false, "retry the execution even if it has already succeeded")
+		fs.Parse(args[1:])
+		if fs.NArg() != 2 {
+			usage()
+		}
+		e, err := newEnv(ctx)
+		if err != nil {
+			log.Fatalf("Could not set up: %v", err)
+		}
+		if err := retry(ctx, e, fs.Arg(0), fs.Arg(1), *force); err != nil {
+			log.Fatalf("Could not retry %q: %v", fs.Arg(1), err)
+		}
+	case "skip":
+		if len(args) != 3 && len(args) != 4 {
+			usage()
+		}
+		var artifactsDir string
+		if len(args) == 4 {
+			artifactsDir = args[3]
+		}
+		e, err := newEnv(ctx)
+		if err != nil {
+			log.Fatalf("Could not set up: %v", err)
+		}
+		if err := skip(ctx, e, args[1], args[2], artifactsDir); err != nil {
+			log.Fatalf("Could not skip %q: %v", args[2], err)
+		}
+	case "approve":
+		fs := flag.NewFlagSet("approve", flag.ExitOnError)
+		comment := fs.String("comment", "", "note to record with the approval")
+		fs.Parse(args[1:])
+		if fs.NArg() != 2 {
+			usage()
+		}
+		e, err := newEnv(ctx)
+		if err != nil {
+			log.Fatalf("Could not set up: %v", err)
+		}
+		if err := approve(ctx, e, fs.Arg(0), fs.Arg(1), *comment); err != nil {
+			log.Fatalf("Could not approve %q: %v", fs.Arg(1), err)
+		}
+	case "cancel":
+		if len(args) != 2 {
+			usage()
+		}
+		e, err := newEnv(ctx)
+		if err != nil {
+			log.Fatalf("Could not set up: %v", err)
+		}
+		if err := cancel(ctx, e, args[1]); err != nil {
+			log.Fatalf("Could not cancel workflow: %v", err)
+		}
+	case "gc":
+		fs := flag.NewFlagSet("gc", flag.ExitOnError)
+		olderThan := ageFlag(7 * 24 * time.Hour)
+		fs.Var(&olderThan, "older-than", "how long ago a workflow must have finished for its topic and subscriptions to be deleted, like 7d")
+		artifactRetention := ageFlag(0)
+		fs.Var(&artifactRetention, "artifact-retention", "how long ago a workflow must have finished for its artifacts to be deleted, or 0 to keep them")
+		dryRun := fs.Bool("dry-run", false, "only say what would be deleted")
+		fs.Parse(args[1:])
+		if fs.NArg() != 0 {
+			usage()
+		}
+		e, err := newEnv(ctx)
+		if err != nil {
+			log.Fatalf("Could not set up: %v", err)
+		}
+		if err := gc(ctx, e, time.Duration(olderThan), time.Duration(artifactRetention), *dryRun); err != nil {
+			log.Fatalf("Could not collect garbage: %v", err)
+		}
+	case "list":
+		fs := flag.NewFlagSet("list", flag.ExitOnError)
+		status := fs.String("status", "", "only list workflows that are running, succeeded, failed or cancelled")
+		since := ageFlag(7 * 24 * time.Hour)
+		fs.Var(&since, "since", "only list workflows started within this long, like 7d, or 0 for all of them")
+		until := ageFlag(0)
+		fs.Var(&until, "until", "only list workflows started at least this long ago")
+		format := fs.String("format", "table", "output format, table or json")
+		fs.Parse(args[1:])
+		if fs.NArg() != 0 {
+			usage()
+		}
+		e, err := newEnv(ctx)
+		if err != nil {
+			log.Fatalf("Could not set up: %v", err)
+		}
+		if err := list(ctx, e, *status, time.Duration(since), time.Duration(until), *format, os.Stdout); err != nil {
+			log.Fatalf("Could not list workflows: %v", err)
+		}
+	default:
+		usage()
 	}
-
-	// WAIT PROCESS
-	// Create subscription to watch for completions
-	// Inspect coord logs for completions
-	// Wait for remaining completions on pubsub
-
-	// DESCRIBE PROCESS
-	// ?
-
-	// RETRY PROCESS
-	// Cancel existing execution
-	// Begin execution
-
-	// SKIP PROCESS
-	// Cancel existing execution
-	// Publish completion
 }
 
-func buildFromOp(op *v1cloudbuild.Operation) (*v1cloudbuild.Build, error) {
-	md := struct {
-		T     string              `json:"@type"`
-		Build *v1cloudbuild.Build `json:"build"`
-	}{}
-	if err := json.Unmarshal(op.Metadata, &md); err != nil {
-		return nil, err
-	}
-	return md.Build, nil
+// env holds the project and clients that flargo commands work with.
+type env struct {
+	projectID  string
+	account    string
+	pubsub     *v1pubsub.Service
+	storage    *storage.Client
+	executions executions.Client
 }
 
-func start(ctx context.Context, cfg *config.Config) error {
+// newEnv bootstraps on the gcloud credentials and project property.
+func newEnv(ctx context.Context) (*env, error) {
 	scfg, err := auth.NewSDK("")
 	if err != nil {
-		return fmt.Errorf("could not find SDK config: %v", err)
+		return nil, fmt.Errorf("could not find SDK config: %v", err)
 	}
 
 	ch, err := auth.ReadConfigHelper()
 	if err != nil {
-		return fmt.Errorf("could not read SDK config helper: %v", err)
+		return nil, fmt.Errorf("could not read SDK config helper: %v", err)
 	}
 
 	projectID, ok := ch.GetProperty("core", "project")
 	if !ok {
-		return errors.New("no project property set")
+		return nil, errors.New("no project property set")
 	}
+	account, _ := ch.GetProperty("core", "account")
 
 	cb, err := v1cloudbuild.New(scfg.Client(ctx))
 	if err != nil {
-		return fmt.Errorf("could not create cloudbuild client: %v", err)
+		return nil, fmt.Errorf("could not create cloudbuild client: %v", err)
 	}
 	ps, err := v1pubsub.New(scfg.Client(ctx))
 	if err != nil {
-		return fmt.Errorf("could not create pubsub client: %v", err)
+		return nil, fmt.Errorf("could not create pubsub client: %v", err)
 	}
 	sc, err := storage.NewClient(ctx, option.WithTokenSource(scfg))
 	if err != nil {
-		return fmt.Errorf("could not create storage client: %v", err)
+		return nil, fmt.Errorf("could not create storage client: %v", err)
+	}
+	return &env{
+		projectID: projectID,
+		account:   account,
+		pubsub:    ps,
+		storage:   sc,
+		executions: executions.Client{
+			Backend: executions.CloudBuild{
+				ProjectID: projectID,
+				Builds:    cb,
+				Storage:   sc,
+			},
+		},
+	}, nil
+}
+
+// openConfig reads a config file, or a file that one imports, from GCS if its
+// path is a gs:// URL. An env without a storage client gets one from the
+// gcloud credentials.
+func (e *env) openConfig(path string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(path, "gs://") {
+		return os.Open(path)
+	}
+	tokens := strings.SplitN(strings.TrimPrefix(path, "gs://"), "/", 2)
+	if len(tokens) != 2 {
+		return nil, fmt.Errorf("invalid GCS path %q", path)
+	}
+	if e.storage == nil {
+		scfg, err := auth.NewSDK("")
+		if err != nil {
+			return nil, fmt.Errorf("could not find SDK config: %v", err)
+		}
+		if e.storage, err = storage.NewClient(context.Background(), option.WithTokenSource(scfg)); err != nil {
+			return nil, fmt.Errorf("could not create storage client: %v", err)
+		}
+	}
+	return e.storage.Bucket(tokens[0]).Object(tokens[1]).NewReader(context.Background())
+}
+
+// loadState rebuilds a workflow's state from its manifest and event log.
+// Workflows started before there were manifests have only the messages in
+// their coord log.
+func loadState(ctx context.Context, e *env, workflowID string) (*workflow.State, error) {
+	state, err := workflow.LoadState(ctx, e.storage, e.projectID, workflowID)
+	if err != storage.ErrObjectNotExist {
+		return state, err
+	}
+
+	state = workflow.NewState()
+	coordLog, err := e.executions.FetchBuildLog(ctx, workflowID)
+	if err != nil && err != storage.ErrObjectNotExist {
+		return nil, fmt.Errorf("could not fetch workflow log: %v", err)
+	}
+	for _, m := range workflow.ParseLog(coordLog) {
+		state.Apply(m)
+	}
+	return state, nil
+}
+
+// paramFlag collects --param flags.
+type paramFlag map[string]string
+
+func (p paramFlag) String() string {
+	var kvs []string
+	for k, v := range p {
+		kvs = append(kvs, k+"="+v)
 	}
-	executionsClient := executions.Client{
-		ProjectID: projectID,
-		Builds:    cb,
-		Storage:   sc,
+	sort.Strings(kvs)
+	return strings.Join(kvs, ",")
+}
+
+func (p paramFlag) Set(s string) error {
+	tokens := strings.SplitN(s, "=", 2)
+	if len(tokens) != 2 {
+		return fmt.Errorf("expected KEY=VALUE, got %q", s)
 	}
+	p[tokens[0]] = tokens[1]
+	return nil
+}
+
+// parseAround parses flags on either side of the one positional argument, so
+// that params can follow the config.
+func parseAround(fs *flag.FlagSet, args []string) {
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		return
+	}
+	pos := fs.Arg(0)
+	fs.Parse(fs.Args()[1:])
+	fs.Parse(append([]string{pos}, fs.Args()...))
+}
+
+// start starts a workflow and returns its ID. Once the coord build exists, its
+// ID is returned along with any error.
+func start(ctx context.Context, e *env, cfg *config.Config, opts workflow.Options) (string, error) {
+	projectID := e.projectID
+	ps := e.pubsub
+	sc := e.storage
+	executionsClient := e.executions
+
+	params, err := cfg.ResolveParameters(opts.Params)
+	if err != nil {
+		return "", err
+	}
+	opts.Params = params
 
 	cfgDir, _ := filepath.Split(cfg.Path)
 
 	// Load execution configs
 	bconfigs := map[string]*v1cloudbuild.Build{}
 	for _, execution := range cfg.Executions {
-		b, err := executions.LoadBuild(filepath.Join(cfgDir, execution.Path))
+		if execution.Type == config.TypeWait {
+			// Approval gates have no build.
+			continue
+		}
+		b, err := executions.LoadExecutionBuild(cfgDir, execution)
 		if err != nil {
-			return err
+			return "", err
 		}
 		bconfigs[execution.Name] = b
 	}
 
-	// Start coord
-	op, err := cb.Projects.Builds.Create(projectID, &v1cloudbuild.Build{
+	// Ensure a GCS place for artifacts, which is also where the workflow is
+	// recorded.
+	gcsBucket := workflow.ArtifactsBucket(projectID)
+	// Create the bucket. If it exists, ensure that it's owned by this project to avoid artifact theft.
+	if err := sc.Bucket(gcsBucket).Create(ctx, projectID, nil); err != nil {
+		// if 409, fetch the bucket to compare project IDs.
+		gerr, ok := err.(*googleapi.Error)
+		if ok && gerr.Code == 409 {
+			policy, err := sc.Bucket(gcsBucket).IAM().Policy(ctx)
+			if err != nil {
+				return "", fmt.Errorf("could not check policy of gs://%s: %v", gcsBucket, err)
+			}
+			if !policy.HasRole("projectOwner:"+projectID, "roles/storage.legacyBucketOwner") {
+				jdata, _ := json.MarshalIndent(policy, " ", " ")
+				log.Printf("Artifacts bucket policy:\n%s\n", jdata)
+				return "", errors.New("artifacts bucket exists, but is owned by someone else")
+			}
+		} else {
+			return "", fmt.Errorf("could not create artifact bucket: %v", err)
+		}
+	}
+
+	// Start coord. Its build lasts as long as the workflow, and ends with the
+	// workflow's result, so it gets as long as cloudbuild allows.
+	workflowID, err := executionsClient.SubmitBuild(ctx, &v1cloudbuild.Build{
 		Steps: []*v1cloudbuild.BuildStep{{
-			Name: "gcr.io/cloud-workflows/coord",
+			Name: executions.CoordImage,
 			Args: []string{"$BUILD_ID"},
 		}},
-	}).Context(ctx).Do()
+		Timeout: executions.Timeout(executions.MaxTimeout),
+		Tags:    []string{workflow.WorkflowTag},
+	})
 	if err != nil {
-		return fmt.Errorf("could not create coord execution: %v", err)
+		return "", fmt.Errorf("could not create coord execution: %v", err)
 	}
 
-	b, err := buildFromOp(op)
-	if err != nil {
-		return fmt.Errorf("could not unmarshal build: %v", err)
-	}
-
-	workflowID := b.Id
-
 	log.Printf("Workflow ID: %s", workflowID)
 
-	// Check the coord execution log to see when it creates the topic.
+	// Wait for the coord execution to subscribe to the topic, so that it
+	// sees everything published from here on.
 	// We can't create the topic before hand because it has the build ID
 	// in it, and we don't know that until the coord execution begins.
+	coordSubscription := workflow.CoordSubscriptionName(projectID, workflowID)
+	bootstrapTimeout := opts.BootstrapTimeout
+	if bootstrapTimeout == 0 {
+		bootstrapTimeout = workflow.DefaultBootstrapTimeout
+	}
+	deadline := time.Now().Add(bootstrapTimeout)
 	for {
-		execLog, err := executionsClient.FetchBuildLog(ctx, workflowID)
-		if err != nil && err != storage.ErrObjectNotExist {
-			return fmt.Errorf("could not fetch workflow log: %v", err)
-		}
-		if err == nil && strings.Contains(execLog, "Created topic") {
+		_, err := ps.Projects.Subscriptions.Get(coordSubscription).Context(ctx).Do()
+		if err == nil {
 			break
 		}
+		if gerr, ok := err.(*googleapi.Error); !ok || gerr.Code != 404 {
+			return workflowID, fmt.Errorf("could not check for coord subscription: %v", err)
+		}
+		if time.Now().After(deadline) {
+			if err := executionsClient.CancelBuild(ctx, workflowID); err != nil {
+				log.Printf("Could not cancel coord build %s: %v", workflowID, err)
+			}
+			return workflowID, fmt.Errorf("coord did not start within %s", bootstrapTimeout)
+		}
 		time.Sleep(time.Second)
 	}
 	// This topic was created by the coord execution.
-	tname := fmt.Sprintf("workflow-%s", workflowID)
-	workflowTopic := fmt.Sprintf("projects/%s/topics/%s", projectID, tname)
+	workflowTopic := workflow.TopicName(projectID, workflowID)
 	log.Printf("worklow topic: %s", workflowTopic)
 
-	// Ensure a GCS place for artifacts.
-	gcsBucket := fmt.Sprintf("%s_workflow_artifacts", projectID)
-	gcsPrefix := fmt.Sprintf("gs://%s/%s", gcsBucket, workflowID)
-	// Create the bucket. If it exists, ensure that it's owned by this project to avoid artifact theft.
-	if err := sc.Bucket(gcsBucket).Create(ctx, projectID, nil); err != nil {
-		// if 409, fetch the bucket to compare project IDs.
-		gerr, ok := err.(*googleapi.Error)
-		if ok && gerr.Code == 409 {
-			policy, err := sc.Bucket(gcsBucket).IAM().Policy(ctx)
-			if err != nil {
-				return fmt.Errorf("could not check policy of gs://%s: %v", gcsBucket, err)
-			}
-			if !policy.HasRole("projectOwner:"+projectID, "roles/storage.legacyBucketOwner") {
-				jdata, _ := json.MarshalIndent(policy, " ", " ")
-				log.Printf("Artifacts bucket policy:\n%s\n", jdata)
-				return errors.New("artifacts bucket exists, but is owned by someone else")
-			}
-		} else {
-			return fmt.Errorf("could not create artifact bucket: %v", err)
-		}
+	// Record the workflow, so that later flargo commands know what it is.
+	if err := workflow.WriteManifest(ctx, sc, projectID, &workflow.Manifest{
+		WorkflowID: workflowID,
+		Config:     cfg,
+		Options:    opts,
+		Builds:     bconfigs,
+		StartedBy:  e.account,
+		StartTime:  time.Now().UTC().Format(time.RFC3339),
+	}); err != nil {
+		return workflowID, fmt.Errorf("could not write workflow manifest: %v", err)
+	}
+	if err := workflow.Publish(ctx, ps, workflowTopic, workflow.Message{
+		Config:  cfg,
+		Options: &opts,
+	}); err != nil {
+		return workflowID, err
 	}
 
+	gcsPrefix := workflow.ArtifactsPrefix(projectID, workflowID)
 	log.Printf("Artifacts go to %s", gcsPrefix)
 
+	if opts.Scheduling == workflow.SchedulingLazy {
+		log.Printf("coord will start each execution once its dependencies have completed")
+		return workflowID, nil
+	}
+
 	// For each execution,
 	execErrors := make(chan error, len(cfg.Executions))
 	var execWG sync.WaitGroup
 	for i, execution := range cfg.Executions {
+		if execution.Type == config.TypeWait {
+			log.Printf("%q is awaiting approval", execution.Name)
+			continue
+		}
+		if execution.When != nil {
+			log.Printf("coord will start %q if %s", execution.Name, execution.When)
+			continue
+		}
 		execWG.Add(1)
 		go func(i int, execution config.Execution) {
 			defer execWG.Done()
 			// - Create subscription
 			sname := fmt.Sprintf("workflow-%s-%d", workflowID, i)
-			executionSubscription := fmt.Sprintf("projects/%s/subscriptions/%s", projectID, sname)
+			executionSubscription := workflow.SubscriptionName(projectID, sname)
 
 			log.Printf("%q execution subscription: %s", execution.Name, sname)
 			if _, err := ps.Projects.Subscriptions.Create(executionSubscription, &v1pubsub.Subscription{
@@ -227,76 +530,23 @@ func start(ctx context.Context, cfg *config.Config) error {
 				return
 			}
 
-			var waitExecutions []string
-			for _, param := range execution.Params {
-				waitExecutions = append(waitExecutions, param.Name)
-			}
-
 			// - Augment steps with wait/complete
 			build := bconfigs[execution.Name]
-
-			build.Steps = append([]*v1cloudbuild.BuildStep{{
-				Name: "gcr.io/cloud-workflows/wait",
-				Args: append(
-					[]string{
-						gcsPrefix,
-						workflowID,
-						executionSubscription,
-					},
-					waitExecutions...,
-				),
-			}}, build.Steps...)
-			build.Steps = append(build.Steps,
-				&v1cloudbuild.BuildStep{
-					Name: "gcr.io/cloud-workflows/complete",
-					Args: []string{
-						gcsPrefix,
-						workflowID,
-						execution.Name,
-					},
-				},
-			)
-
-			// Ensure that each step (including wait and complete) have access to the artifacts volume.
-			// The artifacts will be populated by wait, and will be copied out by complete.
-			for _, b := range build.Steps {
-				b.Volumes = append(b.Volumes, &v1cloudbuild.Volume{
-					Name: "workflow_artifacts",
-					Path: "/workflow_artifacts",
-				})
-			}
+			workflow.AugmentBuild(build, gcsPrefix, workflowID, executionSubscription, execution, opts, 1, nil)
 
 			// - Begin execution
-			op, err := cb.Projects.Builds.Create(projectID, build).Context(ctx).Do()
-			if err != nil {
-				execErrors <- fmt.Errorf("could not create %q execution: %v", execution.Name, err)
+			if _, err := submitExecution(ctx, e, workflowID, build, execution, 1); err != nil {
+				execErrors <- err
 				return
 			}
-			if executionBuild, err := buildFromOp(op); err != nil {
-				execErrors <- fmt.Errorf("could not understand %q execution: %v", execution.Name, err)
-				return
-			} else {
-				log.Printf("%q execution is build %s", execution.Name, executionBuild.Id)
-			}
 		}(i, execution)
 	}
 
 	execWG.Wait()
 	close(execErrors)
 	for err := range execErrors {
-		return err
+		return workflowID, err
 	}
 
-	return nil
-}
-
-type coord struct {
-}
-
-func startCoord() (*coord, error) {
-	return nil, nil
-}
-
-func getCoord(workflowID string) (*coord, error) {
-	return nil, nil
+	return workflowID, nil
 }
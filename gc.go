@@ -0,0 +1,324 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	v1pubsub "google.golang.org/api/pubsub/v1"
+
+	"github.com/skelterjohn/flargo/workflow"
+)
+
+// deletedTopic is the topic pubsub gives a subscription once its topic has been
+// deleted.
+const deletedTopic = "_deleted-topic_"
+
+// A collector finds what is left of finished workflows by the names flargo
+// gives things, and deletes it.
+type collector struct {
+	e *env
+	// olderThan is how long ago a workflow must have finished for its topic
+	// to be deleted, and artifactRetention for its artifacts. Artifacts are
+	// kept forever if artifactRetention is 0.
+	olderThan         time.Duration
+	artifactRetention time.Duration
+	// dryRun says what would be deleted without deleting it.
+	dryRun bool
+
+	// finished has when each workflow's coord build ended, as far as it has
+	// been looked up, and ours whether each topic's workflow is flargo's.
+	finished map[string]time.Time
+	ours     map[string]bool
+}
+
+// gc deletes the topics and subscriptions of workflows that finished longer
+// than olderThan ago, subscriptions whose topic is gone, and the artifacts of
+// workflows that finished longer than artifactRetention ago.
+func gc(ctx context.Context, e *env, olderThan, artifactRetention time.Duration, dryRun bool) error {
+	c := &collector{
+		e:                 e,
+		olderThan:         olderThan,
+		artifactRetention: artifactRetention,
+		dryRun:            dryRun,
+		finished:          map[string]time.Time{},
+		ours:              map[string]bool{},
+	}
+	if err := c.topics(ctx); err != nil {
+		return err
+	}
+	if err := c.subscriptions(ctx); err != nil {
+		return err
+	}
+	if c.artifactRetention == 0 {
+		return nil
+	}
+	return c.artifacts(ctx)
+}
+
+// notFound is true if cloudbuild says there is no such build. It answers 400
+// for an ID that could not be a build's.
+func notFound(err error) bool {
+	gerr, ok := err.(*googleapi.Error)
+	return ok && (gerr.Code == 400 || gerr.Code == 404)
+}
+
+// isOurs is true if the workflow is one of flargo's, since anything can make a
+// topic called workflow-something. A workflow has a manifest, or a coord build
+// with the workflow tag.
+func (c *collector) isOurs(ctx context.Context, workflowID string) (bool, error) {
+	if ours, ok := c.ours[workflowID]; ok {
+		return ours, nil
+	}
+	_, err := workflow.ReadManifest(ctx, c.e.storage, c.e.projectID, workflowID)
+	ours := err == nil
+	if err != nil && err != storage.ErrObjectNotExist && err != storage.ErrBucketNotExist {
+		return false, fmt.Errorf("could not read manifest of %s: %v", workflowID, err)
+	}
+	if !ours {
+		b, err := c.e.executions.FetchBuild(ctx, workflowID)
+		if err != nil && !notFound(err) {
+			return false, fmt.Errorf("could not get coord build %s: %v", workflowID, err)
+		}
+		if err == nil {
+			for _, tag := range b.Tags {
+				if tag == workflow.WorkflowTag {
+					ours = true
+				}
+			}
+		}
+	}
+	c.ours[workflowID] = ours
+	return ours, nil
+}
+
+// expired is true if the workflow finished longer than age ago. A workflow
+// whose coord build no longer exists finished long ago. A workflow parked on a
+// failure has not finished until its coord build ends, since until then it can
+// still be retried or skipped.
+func (c *collector) expired(ctx context.Context, workflowID string, age time.Duration) (bool, error) {
+	finished, ok := c.finished[workflowID]
+	if !ok {
+		b, err := c.e.executions.FetchBuild(ctx, workflowID)
+		if notFound(err) {
+			b, err = nil, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("could not get coord build %s: %v", workflowID, err)
+		}
+		switch {
+		case b == nil:
+			// The zero time.
+		case b.Status == "QUEUED" || b.Status == "WORKING":
+			// Still going, so it is not remembered as finished.
+			return false, nil
+		default:
+			if finished, err = time.Parse(time.RFC3339Nano, b.FinishTime); err != nil {
+				return false, fmt.Errorf("could not parse finish time of coord build %s: %v", workflowID, err)
+			}
+		}
+		c.finished[workflowID] = finished
+	}
+	return time.Since(finished) > age, nil
+}
+
+// remove logs what is being deleted, and deletes it unless this is a dry run.
+func (c *collector) remove(what string, del func() error) error {
+	if c.dryRun {
+		log.Printf("Would delete %s", what)
+		return nil
+	}
+	if err := del(); err != nil {
+		return fmt.Errorf("could not delete %s: %v", what, err)
+	}
+	log.Printf("Deleted %s", what)
+	return nil
+}
+
+// topics deletes the topics of expired workflows, along with every
+// subscription to them.
+func (c *collector) topics(ctx context.Context) error {
+	var topics []string
+	if err := c.e.pubsub.Projects.Topics.List("projects/"+c.e.projectID).Pages(ctx, func(resp *v1pubsub.ListTopicsResponse) error {
+		for _, t := range resp.Topics {
+			topics = append(topics, t.Name)
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("could not list topics: %v", err)
+	}
+
+	for _, topic := range topics {
+		if !strings.HasPrefix(path.Base(topic), "workflow-") {
+			continue
+		}
+		workflowID := strings.TrimPrefix(path.Base(topic), "workflow-")
+		ours, err := c.isOurs(ctx, workflowID)
+		if err != nil {
+			return err
+		}
+		if !ours {
+			log.Printf("Skipping topic %q, which is not a flargo workflow's", topic)
+			continue
+		}
+		expired, err := c.expired(ctx, workflowID, c.olderThan)
+		if err != nil {
+			return err
+		}
+		if !expired {
+			continue
+		}
+
+		var subscriptions []string
+		if err := c.e.pubsub.Projects.Topics.Subscriptions.List(topic).Pages(ctx, func(resp *v1pubsub.ListTopicSubscriptionsResponse) error {
+			subscriptions = append(subscriptions, resp.Subscriptions...)
+			return nil
+		}); err != nil {
+			return fmt.Errorf("could not list subscriptions of %q: %v", topic, err)
+		}
+		for _, sname := range subscriptions {
+			if err := c.remove(fmt.Sprintf("subscription %q", sname), func() error {
+				_, err := c.e.pubsub.Projects.Subscriptions.Delete(sname).Context(ctx).Do()
+				return err
+			}); err != nil {
+				return err
+			}
+		}
+		if err := c.remove(fmt.Sprintf("topic %q", topic), func() error {
+			_, err := c.e.pubsub.Projects.Topics.Delete(topic).Context(ctx).Do()
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subscriptions deletes flargo's subscriptions whose topic has already been
+// deleted, since nothing will be published to them again.
+func (c *collector) subscriptions(ctx context.Context) error {
+	var orphans []string
+	if err := c.e.pubsub.Projects.Subscriptions.List("projects/"+c.e.projectID).Pages(ctx, func(resp *v1pubsub.ListSubscriptionsResponse) error {
+		for _, s := range resp.Subscriptions {
+			if s.Topic != deletedTopic {
+				continue
+			}
+			if name := path.Base(s.Name); strings.HasPrefix(name, "workflow-") || strings.HasPrefix(name, "coord-") {
+				orphans = append(orphans, s.Name)
+			}
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("could not list subscriptions: %v", err)
+	}
+
+	for _, sname := range orphans {
+		if err := c.remove(fmt.Sprintf("subscription %q", sname), func() error {
+			_, err := c.e.pubsub.Projects.Subscriptions.Delete(sname).Context(ctx).Do()
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// artifacts deletes everything kept in GCS for each workflow that finished
+// longer than the retention ago, which includes its manifest and event log.
+func (c *collector) artifacts(ctx context.Context) error {
+	bucket := c.e.storage.Bucket(workflow.ArtifactsBucket(c.e.projectID))
+	var workflowIDs []string
+	it := bucket.Objects(ctx, &storage.Query{
+		Delimiter: "/",
+	})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done || err == storage.ErrBucketNotExist {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("could not list artifacts: %v", err)
+		}
+		if attrs.Prefix != "" {
+			workflowIDs = append(workflowIDs, strings.TrimSuffix(attrs.Prefix, "/"))
+		}
+	}
+
+	for _, workflowID := range workflowIDs {
+		expired, err := c.expired(ctx, workflowID, c.artifactRetention)
+		if err != nil {
+			return err
+		}
+		if !expired {
+			continue
+		}
+		var names []string
+		it := bucket.Objects(ctx, &storage.Query{
+			Prefix: workflowID + "/",
+		})
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("could not list artifacts of %s: %v", workflowID, err)
+			}
+			names = append(names, attrs.Name)
+		}
+		if err := c.remove(fmt.Sprintf("%d artifacts of workflow %s", len(names), workflowID), func() error {
+			for _, name := range names {
+				if err := bucket.Object(name).Delete(ctx); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ageFlag is a duration that may also be given in days, like 7d.
+type ageFlag time.Duration
+
+func (a *ageFlag) String() string {
+	return time.Duration(*a).String()
+}
+
+func (a *ageFlag) Set(s string) error {
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return fmt.Errorf("invalid age %q", s)
+		}
+		*a = ageFlag(time.Duration(n) * 24 * time.Hour)
+		return nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid age %q", s)
+	}
+	*a = ageFlag(d)
+	return nil
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+
+	"github.com/skelterjohn/flargo/executions"
+	"github.com/skelterjohn/flargo/workflow"
+)
+
+// statusCancelled is how flargo list shows a workflow whose coord build was
+// cancelled, which flargo cancel does.
+const statusCancelled = "cancelled"
+
+type workflowDescription struct {
+	ID         string `json:"id"`
+	Config     string `json:"config,omitempty"`
+	StartedBy  string `json:"startedBy,omitempty"`
+	Status     string `json:"status"`
+	CreateTime string `json:"createTime"`
+}
+
+// list writes the workflows started in the last since, but not in the last
+// until, to w, newest first. If status is not empty, only workflows with that
+// status are listed.
+func list(ctx context.Context, e *env, status string, since, until time.Duration, format string, w io.Writer) error {
+	if format != "table" && format != "json" {
+		return fmt.Errorf("unknown format %q", format)
+	}
+	switch status {
+	case "", string(workflow.StatusRunning), string(workflow.StatusSucceeded), string(workflow.StatusFailed), statusCancelled:
+	default:
+		return fmt.Errorf("unknown status %q", status)
+	}
+
+	now := time.Now()
+	var start time.Time
+	if since != 0 {
+		start = now.Add(-since)
+	}
+	builds, err := e.executions.ListBuilds(ctx, workflow.WorkflowTag, start)
+	if err != nil {
+		return fmt.Errorf("could not list coord builds: %v", err)
+	}
+
+	var descs []workflowDescription
+	for _, b := range builds {
+		created, err := time.Parse(time.RFC3339Nano, b.CreateTime)
+		if err != nil {
+			return fmt.Errorf("could not parse create time of coord build %s: %v", b.Id, err)
+		}
+		if now.Sub(created) < until {
+			continue
+		}
+		desc := workflowDescription{
+			ID:         b.Id,
+			CreateTime: b.CreateTime,
+		}
+		// The manifest says how the workflow was started, and the event log
+		// how it ended. Workflows from before there were manifests go
+		// without.
+		state := workflow.NewState()
+		m, err := workflow.ReadManifest(ctx, e.storage, e.projectID, b.Id)
+		switch {
+		case err == storage.ErrObjectNotExist:
+		case err != nil:
+			return fmt.Errorf("could not read manifest of %s: %v", b.Id, err)
+		default:
+			desc.StartedBy = m.StartedBy
+			if m.Config != nil {
+				desc.Config = path.Base(m.Config.Path)
+			}
+			state.Apply(workflow.Message{
+				Config:  m.Config,
+				Options: &m.Options,
+			})
+			events, err := workflow.ReadEvents(ctx, e.storage, e.projectID, b.Id)
+			if err != nil {
+				return fmt.Errorf("could not read events of %s: %v", b.Id, err)
+			}
+			for _, event := range events {
+				state.Apply(event)
+			}
+		}
+		desc.Status = workflowStatus(state, b.Status)
+		if status != "" && desc.Status != status {
+			continue
+		}
+		descs = append(descs, desc)
+	}
+
+	if format == "json" {
+		jdata, err := json.MarshalIndent(descs, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", jdata)
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "WORKFLOW\tCONFIG\tSTARTED BY\tSTATUS\tAGE")
+	for _, d := range descs {
+		created, _ := time.Parse(time.RFC3339Nano, d.CreateTime)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", d.ID, orDash(d.Config), orDash(d.StartedBy), d.Status, age(now.Sub(created)))
+	}
+	return tw.Flush()
+}
+
+// workflowStatus is the status of a workflow, going by its result if it has
+// one, and otherwise by the status of its coord build. A parked workflow has
+// failed while coord is still running.
+func workflowStatus(state *workflow.State, build string) string {
+	switch {
+	case state.Cancelled:
+		return statusCancelled
+	case state.Result != "":
+		return string(state.Result)
+	case build == "QUEUED" || build == "WORKING":
+		return string(workflow.StatusRunning)
+	case build == "SUCCESS":
+		return string(workflow.StatusSucceeded)
+	case build == "CANCELLED":
+		return statusCancelled
+	case executions.BuildFailed(build):
+		return string(workflow.StatusFailed)
+	}
+	return strings.ToLower(build)
+}
+
+// age rounds d to the largest unit that fits, like 5m or 3d.
+func age(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d/time.Second))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d/time.Minute))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(d/time.Hour))
+	}
+	return fmt.Sprintf("%dd", int(d/(24*time.Hour)))
+}
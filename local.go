@@ -0,0 +1,171 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	v1cloudbuild "google.golang.org/api/cloudbuild/v1"
+
+	"github.com/skelterjohn/flargo/config"
+	"github.com/skelterjohn/flargo/executions"
+	"github.com/skelterjohn/flargo/workflow"
+)
+
+// runLocal runs the whole workflow with the local docker daemon, and blocks
+// until it finishes. The current directory is the source for every build.
+func runLocal(ctx context.Context, cfg *config.Config, params map[string]string) error {
+	params, err := cfg.ResolveParameters(params)
+	if err != nil {
+		return err
+	}
+	source, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir("", "flargo-")
+	if err != nil {
+		return err
+	}
+	log.Printf("Artifacts go to %s", dir)
+
+	docker := executions.NewDocker(dir, source, "local")
+	c := executions.Client{
+		Backend: docker,
+	}
+	workflowID := "local"
+
+	state := workflow.NewState()
+	state.Apply(workflow.Message{
+		Config:  cfg,
+		Options: &workflow.Options{Params: params},
+	})
+
+	cfgDir, _ := filepath.Split(cfg.Path)
+	submit := func(execution config.Execution, attempt int) error {
+		var err error
+		build := &v1cloudbuild.Build{}
+		if execution.Type == config.TypeWait {
+			// There is nobody to approve it, so it is just the wait and
+			// complete steps.
+			log.Printf("%q will be approved once its dependencies complete", execution.Name)
+		} else {
+			build, err = executions.LoadExecutionBuild(cfgDir, execution)
+			if err != nil {
+				return err
+			}
+		}
+		workflow.AugmentBuild(build, dir, workflowID, "", state.Inputs(execution.Name), workflow.Options{Params: params}, attempt, nil)
+		buildID, err := c.SubmitBuild(ctx, build)
+		if err != nil {
+			return fmt.Errorf("could not start %q: %v", execution.Name, err)
+		}
+		log.Printf("%q execution attempt %d is build %s", execution.Name, attempt, buildID)
+		state.Apply(workflow.Message{
+			Started: execution.Name,
+			Build:   buildID,
+			Attempt: attempt,
+		})
+		return nil
+	}
+	for _, execution := range cfg.Executions {
+		// Whether these run is decided once their dependencies finish.
+		if execution.When != nil {
+			continue
+		}
+		if err := submit(execution, 1); err != nil {
+			return err
+		}
+	}
+
+	printed := map[string]bool{}
+	cancelled := map[string]bool{}
+	for {
+		if err := checkBuilds(ctx, c, state, cancelled); err != nil {
+			return err
+		}
+		for _, ce := range cfg.Executions {
+			ex := state.Executions[ce.Name]
+			if ce.When == nil || ex.Attempt() != 0 || ex.Status.Terminal() || !state.Ready(ce.Name) {
+				continue
+			}
+			if state.Holds(ce.Name) {
+				if err := submit(ce, 1); err != nil {
+					return err
+				}
+				continue
+			}
+			log.Printf("Skipped %q, since %s does not hold", ce.Name, ce.When)
+			docker.Complete(ce.Name)
+			state.Apply(workflow.Message{
+				Completed: ce.Name,
+				Status:    workflow.StatusSkipped,
+				Skipped:   true,
+			})
+		}
+		for _, ce := range cfg.Executions {
+			ex := state.Executions[ce.Name]
+			if ex.Status != workflow.StatusRetrying {
+				continue
+			}
+			if at, err := time.Parse(time.RFC3339, ex.RetryAt); err == nil && time.Now().Before(at) {
+				continue
+			}
+			if err := submit(ce, ex.Attempt()+1); err != nil {
+				return err
+			}
+		}
+		// Show each build's log once it is done.
+		for _, ce := range cfg.Executions {
+			ex := state.Executions[ce.Name]
+			if !ex.Status.Terminal() || printed[ce.Name] {
+				continue
+			}
+			printed[ce.Name] = true
+			if ex.Build == "" {
+				fmt.Printf("=== %s (%s)\n", ce.Name, ex.Status)
+				continue
+			}
+			buildLog, err := c.FetchBuildLog(ctx, ex.Build)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("=== %s (%s)\n%s", ce.Name, ex.Status, buildLog)
+		}
+		if state.Finished() {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+
+	// Whatever is left is blocked by a failure, and would wait forever.
+	for _, ex := range state.Executions {
+		if !ex.Status.Terminal() && ex.Build != "" {
+			if err := c.CancelBuild(ctx, ex.Build); err != nil {
+				return err
+			}
+		}
+	}
+
+	if failed := state.Failed(); len(failed) != 0 {
+		return fmt.Errorf("failed executions: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
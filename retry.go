@@ -0,0 +1,144 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"golang.org/x/net/context"
+	v1pubsub "google.golang.org/api/pubsub/v1"
+
+	"github.com/skelterjohn/flargo/config"
+	"github.com/skelterjohn/flargo/executions"
+	"github.com/skelterjohn/flargo/workflow"
+)
+
+// findExecution loads the workflow's state and finds the named execution in it,
+// along with its position in the config.
+func findExecution(ctx context.Context, e *env, workflowID, name string) (*workflow.State, int, error) {
+	state, err := loadState(ctx, e, workflowID)
+	if err != nil {
+		return nil, 0, err
+	}
+	if state.Config == nil {
+		return nil, 0, errors.New("workflow config not found")
+	}
+	// Coord has stopped, so nothing would act on a change.
+	if state.Over() {
+		return nil, 0, fmt.Errorf("workflow %s has already %s", workflowID, state.Result)
+	}
+	for i, ce := range state.Config.Executions {
+		if ce.Name == name {
+			return state, i, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("no execution named %q", name)
+}
+
+// cancelExecution cancels the execution's latest build, if it is still going.
+func cancelExecution(ctx context.Context, e *env, ex *workflow.Execution) error {
+	if ex.Build == "" {
+		return nil
+	}
+	status, err := e.executions.FetchBuildStatus(ctx, ex.Build)
+	if err != nil {
+		return fmt.Errorf("could not get status of %q build %s: %v", ex.Name, ex.Build, err)
+	}
+	if status == "SUCCESS" || executions.BuildFailed(status) {
+		return nil
+	}
+	if err := e.executions.CancelBuild(ctx, ex.Build); err != nil {
+		return fmt.Errorf("could not cancel %q build %s: %v", ex.Name, ex.Build, err)
+	}
+	log.Printf("Cancelled %q build %s", ex.Name, ex.Build)
+	return nil
+}
+
+// retry starts a new attempt at the execution and cancels the current one. An
+// execution that has already succeeded is only retried if force is set, since
+// its dependents run again.
+func retry(ctx context.Context, e *env, workflowID, name string, force bool) error {
+	state, i, err := findExecution(ctx, e, workflowID, name)
+	if err != nil {
+		return err
+	}
+	if state.Executions[name].Type == config.TypeWait {
+		return fmt.Errorf("%q is a wait execution, approve or skip it instead", name)
+	}
+	if state.Executions[name].Status == workflow.StatusSucceeded && !force {
+		return fmt.Errorf("%q has already succeeded, use --force to run it again", name)
+	}
+	// The failure has already been announced, so the new attempt would never
+	// hear about it and would wait forever.
+	if state.Options.UpstreamFailure == workflow.UpstreamFailureFail && state.Blocked(name) {
+		return fmt.Errorf("%q is blocked by a failure, retry or skip that first", name)
+	}
+	attempt := state.Executions[name].Attempt() + 1
+
+	// Coord creates the build once the execution is unblocked, and never
+	// waits on anything, so there is nothing to subscribe for. The same goes
+	// for executions with a condition, which coord decided to run.
+	var subscription string
+	if state.Options.Scheduling == workflow.SchedulingLazy || state.Executions[name].When != nil {
+		if !state.Ready(name) {
+			return fmt.Errorf("%q is still waiting for its dependencies, coord will start it once they complete", name)
+		}
+	} else {
+		// Subscribe before looking at the state again, so that a dependency
+		// completing in between is not missed by the new attempt.
+		sname := fmt.Sprintf("workflow-%s-%d-%d", workflowID, i, attempt)
+		subscription = workflow.SubscriptionName(e.projectID, sname)
+		if _, err := e.pubsub.Projects.Subscriptions.Create(subscription, &v1pubsub.Subscription{
+			Name:  sname,
+			Topic: workflow.TopicName(e.projectID, workflowID),
+		}).Context(ctx).Do(); err != nil {
+			return fmt.Errorf("could not create %q subscription: %v", name, err)
+		}
+
+		state, _, err = findExecution(ctx, e, workflowID, name)
+		if err != nil {
+			return err
+		}
+	}
+	ex := state.Executions[name]
+
+	// The manifest has the build as it was started, wherever flargo is run
+	// from now.
+	build := state.Builds[name]
+	if build == nil {
+		cfgDir, _ := filepath.Split(state.Config.Path)
+		build, err = executions.LoadExecutionBuild(cfgDir, ex.Execution)
+		if err != nil {
+			return err
+		}
+	}
+
+	inputs := state.Inputs(name)
+	completed := map[string]bool{}
+	for _, p := range inputs.Params {
+		if state.Executions[p.Name].Status.Done() {
+			completed[p.Name] = true
+		}
+	}
+	workflow.AugmentBuild(build, workflow.ArtifactsPrefix(e.projectID, workflowID), workflowID, subscription, inputs, state.Options, attempt, completed)
+
+	if _, err := submitExecution(ctx, e, workflowID, build, ex.Execution, attempt); err != nil {
+		return err
+	}
+	// The new attempt is announced first, so that coord does not take the
+	// cancellation for a failure.
+	return cancelExecution(ctx, e, ex)
+}
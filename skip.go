@@ -0,0 +1,62 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+
+	"golang.org/x/net/context"
+
+	"github.com/skelterjohn/flargo/workflow"
+)
+
+// skip announces the execution's completion without its current attempt, so
+// that its dependents can go ahead, and cancels the attempt. If artifactsDir is
+// not empty, its contents are uploaded as the execution's out artifacts. An
+// execution that has already succeeded is not skipped, since its dependents
+// have its artifacts.
+func skip(ctx context.Context, e *env, workflowID, name, artifactsDir string) error {
+	state, _, err := findExecution(ctx, e, workflowID, name)
+	if err != nil {
+		return err
+	}
+	if state.Executions[name].Status == workflow.StatusSucceeded {
+		return fmt.Errorf("%q has already succeeded", name)
+	}
+	m := workflow.Message{
+		Completed: name,
+		Status:    workflow.StatusSkipped,
+		Skipped:   true,
+	}
+	bucket := workflow.ArtifactsBucket(e.projectID)
+	object := path.Join(workflowID, name)
+	if artifactsDir != "" {
+		manifest, err := workflow.UploadArtifacts(ctx, e.storage, bucket, object, artifactsDir)
+		if err != nil {
+			return err
+		}
+		m.Artifacts = fmt.Sprintf("gs://%s/%s", bucket, object)
+		m.Manifest = manifest
+		log.Printf("Uploaded %s to %s", artifactsDir, m.Artifacts)
+	}
+
+	if err := workflow.Publish(ctx, e.pubsub, workflow.TopicName(e.projectID, workflowID), m); err != nil {
+		return fmt.Errorf("could not publish completion: %v", err)
+	}
+	log.Printf("Skipped %q", name)
+	// The completion is announced first, so that coord does not take the
+	// cancellation for a failure.
+	return cancelExecution(ctx, e, state.Executions[name])
+}
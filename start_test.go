@@ -0,0 +1,1545 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	v1cloudbuild "google.golang.org/api/cloudbuild/v1"
+	v1pubsub "google.golang.org/api/pubsub/v1"
+
+	"github.com/skelterjohn/flargo/config"
+	"github.com/skelterjohn/flargo/executions"
+	"github.com/skelterjohn/flargo/fakecloud"
+	"github.com/skelterjohn/flargo/workflow"
+)
+
+const fakeProject = "fake-project"
+
+// events records what the fake steps did, in order.
+type events struct {
+	mu   sync.Mutex
+	list []string
+}
+
+func (ev *events) add(format string, args ...interface{}) {
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	ev.list = append(ev.list, fmt.Sprintf(format, args...))
+}
+
+// index is where the event happened, or -1 if it did not.
+func (ev *events) index(e string) int {
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	for i, x := range ev.list {
+		if x == e {
+			return i
+		}
+	}
+	return -1
+}
+
+// newFakeEnv sets up an env that works against a fake cloud, where the coord,
+// wait and complete images do what the real ones do and ubuntu steps run on
+// the local machine.
+func newFakeEnv(ctx context.Context, t *testing.T) (*env, *fakecloud.Cloud, *events) {
+	cloud, err := fakecloud.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := cloud.Storage(ctx)
+	if err != nil {
+		cloud.Close()
+		t.Fatal(err)
+	}
+	e := &env{
+		projectID: fakeProject,
+		account:   "tester@example.com",
+		pubsub:    cloud.PubSub(),
+		storage:   sc,
+		executions: executions.Client{
+			Backend: executions.CloudBuild{
+				ProjectID: fakeProject,
+				Builds:    cloud.Cloudbuild(),
+				Storage:   sc,
+			},
+		},
+	}
+	ev := &events{}
+	cloud.HandleImage(executions.CoordImage, fakeCoord(e))
+	cloud.HandleImage(executions.WaitImage, fakeWait(e))
+	cloud.HandleImage(executions.CompleteImage, fakeComplete(e, ev))
+	cloud.HandleImage("ubuntu", fakeLocal(ev))
+	return e, cloud, ev
+}
+
+// executionName finds which execution a build is for from its complete step.
+func executionName(s *fakecloud.Step) string {
+	steps := s.Build.Steps
+	if last := steps[len(steps)-1]; last.Name == executions.CompleteImage && len(last.Args) == 5 {
+		return last.Args[2]
+	}
+	return ""
+}
+
+func fakeCoord(e *env) fakecloud.StepFunc {
+	return func(ctx context.Context, s *fakecloud.Step) error {
+		c := &workflow.Coordinator{
+			ProjectID:   e.projectID,
+			WorkflowID:  s.Args[0],
+			PubSub:      e.pubsub,
+			Storage:     e.storage,
+			BuildStatus: e.executions.FetchBuildStatus,
+			Submit:      e.executions.SubmitBuild,
+			Cancel:      e.executions.CancelBuild,
+			Log:         s.Log,
+		}
+		return c.Run(ctx)
+	}
+}
+
+func fakeWait(e *env) fakecloud.StepFunc {
+	return func(ctx context.Context, s *fakecloud.Step) error {
+		w, err := workflow.ParseWaiter(s.Args)
+		if err != nil {
+			return err
+		}
+		w.PubSub = e.pubsub
+		w.Storage = e.storage
+		w.Artifacts = s.Volumes["/workflow_artifacts"]
+		return w.Run(ctx)
+	}
+}
+
+func fakeComplete(e *env, ev *events) fakecloud.StepFunc {
+	return func(ctx context.Context, s *fakecloud.Step) error {
+		c, err := workflow.ParseCompleter(s.Args)
+		if err != nil {
+			return err
+		}
+		c.PubSub = e.pubsub
+		c.Storage = e.storage
+		c.ProjectID = e.projectID
+		c.Artifacts = s.Volumes["/workflow_artifacts"]
+		ev.add("completed:%s", s.Args[2])
+		return c.Run(ctx)
+	}
+}
+
+// fakeLocal runs the step on the local machine, with /workflow_artifacts
+// pointing at the build's volume.
+func fakeLocal(ev *events) fakecloud.StepFunc {
+	return func(ctx context.Context, s *fakecloud.Step) error {
+		ev.add("ran:%s", executionName(s))
+		step := s.Build.Steps[s.Index]
+		var args []string
+		for _, arg := range s.Args {
+			args = append(args, strings.Replace(arg, "/workflow_artifacts", s.Volumes["/workflow_artifacts"], -1))
+		}
+		cmd := exec.CommandContext(ctx, step.Entrypoint, args...)
+		cmd.Stdout = s.Log
+		cmd.Stderr = s.Log
+		return cmd.Run()
+	}
+}
+
+// waitForCoord waits a while for the coord build to finish, and returns its
+// status.
+func waitForCoord(t *testing.T, cloud *fakecloud.Cloud, workflowID string) string {
+	var status string
+	for i := 0; i < 100; i++ {
+		status = cloud.Build(workflowID).Status
+		if status != "QUEUED" && status != "WORKING" {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return status
+}
+
+// waitForState loads the workflow's state until it is ready, since coord takes
+// a moment to record each event.
+func waitForState(ctx context.Context, t *testing.T, e *env, workflowID string, ready func(*workflow.State) bool) *workflow.State {
+	for i := 0; ; i++ {
+		state, err := loadState(ctx, e, workflowID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ready(state) || i == 100 {
+			return state
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// writeConfig writes a workflow config and the builds it refers to into a
+// new directory. A build may refer to the directory as TESTDIR.
+func writeConfig(t *testing.T, cfg string, builds map[string]string) string {
+	dir, err := ioutil.TempDir("", "flargo-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, b := range builds {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(strings.Replace(b, "TESTDIR", dir, -1)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfgPath := filepath.Join(dir, "test.wf")
+	if err := ioutil.WriteFile(cfgPath, []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return cfgPath
+}
+
+const (
+	succeedBuild = `
+steps:
+- name: 'ubuntu'
+  entrypoint: 'true'
+`
+	failBuild = `
+steps:
+- name: 'ubuntu'
+  entrypoint: 'false'
+`
+	slowBuild = `
+steps:
+- name: 'ubuntu'
+  entrypoint: 'sleep'
+  args: ['60']
+`
+	// discoverBuild adds two executions to the workflow, one of which also
+	// waits for report.
+	discoverBuild = `
+steps:
+- name: 'ubuntu'
+  entrypoint: 'bash'
+  args:
+  - '-c'
+  - |
+    printf 'steps:\n- name: ubuntu\n  entrypoint: "true"\n' > /workflow_artifacts/out/deploy.yaml
+    printf 'exec: deploy_a() deploy.yaml\nexec: deploy_b(report) deploy.yaml\n' > /workflow_artifacts/out/flargo.wf
+`
+	// flakyBuild fails twice, then succeeds.
+	flakyBuild = `
+steps:
+- name: 'ubuntu'
+  entrypoint: 'bash'
+  args: ['-c', 'cd TESTDIR && test -e twice && exit 0; test -e once && touch twice; touch once; exit 1']
+`
+	// failOnceBuild fails, then succeeds.
+	failOnceBuild = `
+steps:
+- name: 'ubuntu'
+  entrypoint: 'bash'
+  args: ['-c', 'cd TESTDIR && test -e failed && exit 0; touch failed; exit 1']
+`
+	// slowOnceBuild is slow, then quick.
+	slowOnceBuild = `
+steps:
+- name: 'ubuntu'
+  entrypoint: 'bash'
+  args: ['-c', 'cd TESTDIR && test -e slept && exit 0; touch slept; sleep 60']
+`
+	// renameBuild leaves first.txt in its out directory, then second.txt.
+	renameBuild = `
+steps:
+- name: 'ubuntu'
+  entrypoint: 'bash'
+  args: ['-c', 'cd TESTDIR && test -e renamed && exec touch /workflow_artifacts/out/second.txt; touch renamed /workflow_artifacts/out/first.txt']
+`
+)
+
+// builds has every build a workflowTest config may refer to.
+var builds = map[string]string{
+	"succeed.yaml":  succeedBuild,
+	"fail.yaml":     failBuild,
+	"slow.yaml":     slowBuild,
+	"discover.yaml": discoverBuild,
+	"flaky.yaml":    flakyBuild,
+	"failonce.yaml": failOnceBuild,
+	"slowonce.yaml": slowOnceBuild,
+	"rename.yaml":   renameBuild,
+}
+
+// A testWorkflow is a workflow running on a fake cloud.
+type testWorkflow struct {
+	ctx   context.Context
+	e     *env
+	cloud *fakecloud.Cloud
+	ev    *events
+	id    string
+	// dirs has the directories configs were written to.
+	dirs []string
+	// recording is the subscription recordCancels reads.
+	recording string
+}
+
+// start starts another workflow on the same fake cloud, and returns its ID.
+func (w *testWorkflow) start(t *testing.T, cfg string, opts workflow.Options) string {
+	cfgPath := writeConfig(t, cfg, builds)
+	w.dirs = append(w.dirs, filepath.Dir(cfgPath))
+	return w.startFrom(t, cfgPath, opts)
+}
+
+func (w *testWorkflow) startFrom(t *testing.T, cfgPath string, opts workflow.Options) string {
+	cfg, err := config.Load(cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := start(w.ctx, w.e, cfg, opts)
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	return id
+}
+
+// state loads the state of the workflow once coord is done with it.
+func (w *testWorkflow) state(t *testing.T) *workflow.State {
+	state, err := loadState(w.ctx, w.e, w.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+// rejoin waits for the workflow again, giving up after a while.
+func (w *testWorkflow) rejoin() error {
+	ctx, done := context.WithTimeout(w.ctx, 30*time.Second)
+	defer done()
+	return waitWorkflow(ctx, w.e, w.id)
+}
+
+// recordCancels has ev record each build that flargo cancels from now on, as
+// "cancel BUILD", after whatever was published to the workflow's topic before
+// it, as "published started NAME ATTEMPT" or "published completed NAME".
+func (w *testWorkflow) recordCancels(t *testing.T) {
+	sname := "record-" + w.id
+	w.recording = workflow.SubscriptionName(fakeProject, sname)
+	if _, err := w.e.pubsub.Projects.Subscriptions.Create(w.recording, &v1pubsub.Subscription{
+		Name:  sname,
+		Topic: workflow.TopicName(fakeProject, w.id),
+	}).Context(w.ctx).Do(); err != nil {
+		t.Fatal(err)
+	}
+	w.e.executions.Backend = cancelRecorder{w.e.executions.Backend, w}
+}
+
+// recordPublished records what was published since it was last called.
+func (w *testWorkflow) recordPublished(ctx context.Context) error {
+	for {
+		resp, err := w.e.pubsub.Projects.Subscriptions.Pull(w.recording, &v1pubsub.PullRequest{
+			MaxMessages: 10,
+		}).Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+		if len(resp.ReceivedMessages) == 0 {
+			return nil
+		}
+		for _, rmsg := range resp.ReceivedMessages {
+			m, err := workflow.DecodeMessage(rmsg.Message.Data)
+			if err != nil {
+				return err
+			}
+			switch {
+			case m.Started != "":
+				w.ev.add("published started %s %d", m.Started, m.Attempt)
+			case m.Completed != "":
+				w.ev.add("published completed %s", m.Completed)
+			}
+		}
+	}
+}
+
+type cancelRecorder struct {
+	executions.Backend
+	w *testWorkflow
+}
+
+func (r cancelRecorder) Cancel(ctx context.Context, buildID string) error {
+	if err := r.w.recordPublished(ctx); err != nil {
+		return err
+	}
+	r.w.ev.add("cancel %s", buildID)
+	return r.Backend.Cancel(ctx, buildID)
+}
+
+// checkCancelledAfter checks that the build was cancelled after the event.
+func (w *testWorkflow) checkCancelledAfter(t *testing.T, buildID, event string) {
+	if err := w.recordPublished(w.ctx); err != nil {
+		t.Fatal(err)
+	}
+	b, a := w.ev.index(event), w.ev.index("cancel "+buildID)
+	if b == -1 || a == -1 || b > a {
+		t.Errorf("want %s before build %s was cancelled, got %q", event, buildID, w.ev.list)
+	}
+}
+
+// waitForFile waits a while for a build to make the file.
+func waitForFile(t *testing.T, name string) {
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(name); err == nil {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("%s was never made", name)
+}
+
+// A workflowTest runs a workflow on a fake cloud from flargo start to flargo
+// wait, and checks what became of it.
+type workflowTest struct {
+	name string
+	// config is the workflow's config, whose builds come from builds, and
+	// path is a config file to use instead.
+	config string
+	path   string
+	opts   workflow.Options
+	// bash says that the builds need bash, and short that the test is
+	// skipped with -short.
+	bash  bool
+	short bool
+	// during is done once the workflow has started, before waiting for it.
+	during func(t *testing.T, w *testWorkflow)
+
+	// wait is the error flargo wait returns, and coord the status the coord
+	// build ends with. A coord of WORKING is what a parked workflow's coord
+	// build keeps.
+	wait  string
+	coord string
+	// order has pairs of step events, the first of each pair happening
+	// before the second.
+	order [][2]string
+	// statuses has what becomes of executions.
+	statuses map[string]workflow.Status
+	// check checks anything else.
+	check func(t *testing.T, w *testWorkflow, state *workflow.State)
+}
+
+var workflowTests = []workflowTest{{
+	name:  "diamond",
+	path:  "example/test.wf",
+	bash:  true,
+	short: true,
+	coord: "SUCCESS",
+	order: [][2]string{
+		{"completed:start", "ran:left"},
+		{"completed:start", "ran:right"},
+		{"completed:left", "ran:join"},
+		{"completed:right", "ran:join"},
+	},
+	statuses: map[string]workflow.Status{
+		"start": workflow.StatusSucceeded,
+		"left":  workflow.StatusSucceeded,
+		"right": workflow.StatusSucceeded,
+		"join":  workflow.StatusSucceeded,
+	},
+	check: func(t *testing.T, w *testWorkflow, state *workflow.State) {
+		if b := state.Builds["join"]; b == nil || len(b.Steps) != 1 {
+			t.Errorf("manifest has join build %+v, want the one step from join.yaml", b)
+		}
+		joinLog, err := w.e.executions.FetchBuildLog(w.ctx, state.Executions["join"].Build)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{
+			"from my ancestors: here is something for my left descendants",
+			"from my ancestors: here is something for my right descendants",
+		} {
+			if !strings.Contains(joinLog, want) {
+				t.Errorf("join log does not have %q:\n%s", want, joinLog)
+			}
+		}
+		if _, ok := w.cloud.Object(workflow.ArtifactsBucket(fakeProject), w.id+"/start/start.txt"); !ok {
+			t.Errorf("start's artifacts were not uploaded: %q", w.cloud.Objects(workflow.ArtifactsBucket(fakeProject), ""))
+		}
+		manifest := state.Executions["start"].Manifest
+		if len(manifest) != 1 || manifest[0].Path != "start.txt" || manifest[0].Size == 0 {
+			t.Errorf("start's manifest is %+v, want just start.txt", manifest)
+		}
+		if state.Result != workflow.StatusSucceeded {
+			t.Errorf("workflow result is %q, want %s", state.Result, workflow.StatusSucceeded)
+		}
+		for _, name := range []string{"start", "left", "right", "join"} {
+			if !state.Executions[name].Unblocked {
+				t.Errorf("%s was never unblocked", name)
+			}
+		}
+	},
+}, {
+	// Under park, coord keeps going in case build is retried, and the
+	// builds it blocks keep waiting.
+	name: "upstream failure park",
+	config: `
+exec: build() fail.yaml
+exec: test(build) succeed.yaml
+exec: deploy(test) succeed.yaml
+`,
+	wait:  "failed executions: build",
+	coord: "WORKING",
+	statuses: map[string]workflow.Status{
+		"build":  workflow.StatusFailed,
+		"test":   workflow.StatusBlocked,
+		"deploy": workflow.StatusBlocked,
+	},
+	check: func(t *testing.T, w *testWorkflow, state *workflow.State) {
+		checkUpstreamFailure(t, w, state, "WORKING")
+	},
+}, {
+	name: "upstream failure fail",
+	config: `
+exec: build() fail.yaml
+exec: test(build) succeed.yaml
+exec: deploy(test) succeed.yaml
+`,
+	opts:  workflow.Options{UpstreamFailure: workflow.UpstreamFailureFail},
+	wait:  "failed executions: build",
+	coord: "FAILURE",
+	statuses: map[string]workflow.Status{
+		"build":  workflow.StatusFailed,
+		"test":   workflow.StatusBlocked,
+		"deploy": workflow.StatusBlocked,
+	},
+	check: func(t *testing.T, w *testWorkflow, state *workflow.State) {
+		checkUpstreamFailure(t, w, state, "FAILURE")
+	},
+}, {
+	// A build cancelled from outside flargo fails its execution, and is not
+	// retried.
+	name: "external cancel",
+	config: `
+exec: slow() retries=1 backoff=1s slow.yaml
+exec: after(slow) succeed.yaml
+`,
+	opts: workflow.Options{UpstreamFailure: workflow.UpstreamFailureFail},
+	during: func(t *testing.T, w *testWorkflow) {
+		// Coord may announce that slow is unblocked before it records
+		// slow's build.
+		state := waitForState(w.ctx, t, w.e, w.id, func(state *workflow.State) bool {
+			return state.Executions["slow"].Unblocked && state.Executions["slow"].Build != ""
+		})
+		if err := w.e.executions.CancelBuild(w.ctx, state.Executions["slow"].Build); err != nil {
+			t.Fatal(err)
+		}
+	},
+	wait:  "failed executions: slow",
+	coord: "FAILURE",
+	statuses: map[string]workflow.Status{
+		"slow": workflow.StatusFailed,
+	},
+	check: func(t *testing.T, w *testWorkflow, state *workflow.State) {
+		if slow := state.Executions["slow"]; slow.Reason != workflow.ReasonCancelled || slow.Attempt() != 1 {
+			t.Errorf("slow failed with %q after %d attempts, want %s after 1", slow.Reason, slow.Attempt(), workflow.ReasonCancelled)
+		}
+	},
+}, {
+	// With its records gone, waiting for the workflow falls back on
+	// coord's build log.
+	name: "build log",
+	config: `
+exec: build() fail.yaml
+exec: test(build) succeed.yaml
+`,
+	opts:  workflow.Options{UpstreamFailure: workflow.UpstreamFailureFail},
+	wait:  "failed executions: build",
+	coord: "FAILURE",
+	statuses: map[string]workflow.Status{
+		"build": workflow.StatusFailed,
+	},
+	check: func(t *testing.T, w *testWorkflow, state *workflow.State) {
+		bucket := workflow.ArtifactsBucket(fakeProject)
+		for _, name := range w.cloud.Objects(bucket, workflow.RecordPrefix(w.id)+"/") {
+			if err := w.e.storage.Bucket(bucket).Object(name).Delete(w.ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.rejoin(); !waitCameTo(err, "failed executions: build") {
+			t.Errorf("waiting from the build log: got %v, want failed executions: build", err)
+		}
+	},
+}, {
+	name: "describe",
+	config: `
+exec: build() retries=1 backoff=1s fail.yaml
+exec: lint() succeed.yaml
+exec: test(build, lint) succeed.yaml
+exec: deploy(test) succeed.yaml
+`,
+	wait:  "failed executions: build",
+	coord: "WORKING",
+	statuses: map[string]workflow.Status{
+		"build":  workflow.StatusFailed,
+		"lint":   workflow.StatusSucceeded,
+		"test":   workflow.StatusBlocked,
+		"deploy": workflow.StatusBlocked,
+	},
+	check: checkDescribe,
+}, {
+	// A failed execution is retried by hand, as are one still running and
+	// one that has succeeded.
+	name: "retry",
+	config: `
+exec: build() failonce.yaml
+exec: test(build) succeed.yaml
+exec: slow() slowonce.yaml
+exec: lint() rename.yaml
+`,
+	bash: true,
+	during: func(t *testing.T, w *testWorkflow) {
+		waitForFile(t, filepath.Join(w.dirs[0], "slept"))
+		state := waitForState(w.ctx, t, w.e, w.id, func(state *workflow.State) bool {
+			return state.Status("build") == workflow.StatusFailed && state.Status("lint") == workflow.StatusSucceeded
+		})
+		if err := retry(w.ctx, w.e, w.id, "lint", false); err == nil {
+			t.Errorf("retried lint, which had succeeded, without --force")
+		}
+		if err := retry(w.ctx, w.e, w.id, "lint", true); err != nil {
+			t.Errorf("retry lint with --force: %v", err)
+		}
+		w.recordCancels(t)
+		for _, name := range []string{"build", "slow"} {
+			if err := retry(w.ctx, w.e, w.id, name, false); err != nil {
+				t.Fatalf("retry %s: %v", name, err)
+			}
+		}
+		w.checkCancelledAfter(t, state.Executions["slow"].Build, "published started slow 2")
+	},
+	coord: "SUCCESS",
+	order: [][2]string{
+		{"completed:build", "ran:test"},
+	},
+	statuses: map[string]workflow.Status{
+		"build": workflow.StatusSucceeded,
+		"test":  workflow.StatusSucceeded,
+		"slow":  workflow.StatusSucceeded,
+		"lint":  workflow.StatusSucceeded,
+	},
+	check: func(t *testing.T, w *testWorkflow, state *workflow.State) {
+		for name, want := range map[string]int{
+			"build": 2,
+			"slow":  2,
+			"lint":  2,
+			// test's build waited while build was failed, and ran
+			// once build was retried.
+			"test": 1,
+		} {
+			if got := state.Executions[name].Attempt(); got != want {
+				t.Errorf("%s has %d attempts, want %d", name, got, want)
+			}
+		}
+		if got := state.Executions["build"].Attempts[0].Reason; got != "FAILURE" {
+			t.Errorf("build attempt 1 ended with %q, want FAILURE", got)
+		}
+		// lint's second attempt replaced what its first uploaded.
+		want := []string{w.id + "/lint/second.txt"}
+		if got := w.cloud.Objects(workflow.ArtifactsBucket(fakeProject), w.id+"/lint/"); !reflect.DeepEqual(got, want) {
+			t.Errorf("lint's artifacts are %q, want %q", got, want)
+		}
+	},
+}, {
+	// A failed execution is skipped with artifacts to stand in for its own,
+	// and one still running without.
+	name: "skip",
+	config: `
+exec: build() fail.yaml
+exec: test(build as bin) {
+  steps:
+  - name: 'ubuntu'
+    entrypoint: 'test'
+    args: ['-e', '/workflow_artifacts/in/bin/skipped.txt']
+}
+exec: slow() slow.yaml
+exec: after(slow) succeed.yaml
+exec: lint() succeed.yaml
+`,
+	during: func(t *testing.T, w *testWorkflow) {
+		state := waitForState(w.ctx, t, w.e, w.id, func(state *workflow.State) bool {
+			return state.Status("build") == workflow.StatusFailed && state.Status("lint") == workflow.StatusSucceeded && state.Executions["slow"].Build != ""
+		})
+		if err := skip(w.ctx, w.e, w.id, "lint", ""); err == nil {
+			t.Errorf("skipped lint, which had succeeded")
+		}
+		artifacts := filepath.Join(w.dirs[0], "artifacts")
+		if err := os.Mkdir(artifacts, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(artifacts, "skipped.txt"), []byte("skipped"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		w.recordCancels(t)
+		if err := skip(w.ctx, w.e, w.id, "build", artifacts); err != nil {
+			t.Fatalf("skip build: %v", err)
+		}
+		if err := skip(w.ctx, w.e, w.id, "slow", ""); err != nil {
+			t.Fatalf("skip slow: %v", err)
+		}
+		w.checkCancelledAfter(t, state.Executions["slow"].Build, "published completed slow")
+	},
+	coord: "SUCCESS",
+	statuses: map[string]workflow.Status{
+		"build": workflow.StatusSkipped,
+		"test":  workflow.StatusSucceeded,
+		"slow":  workflow.StatusSkipped,
+		"after": workflow.StatusSucceeded,
+		"lint":  workflow.StatusSucceeded,
+	},
+	check: func(t *testing.T, w *testWorkflow, state *workflow.State) {
+		build := state.Executions["build"]
+		if want := workflow.ArtifactsPrefix(fakeProject, w.id) + "/build"; build.Artifacts != want {
+			t.Errorf("build's artifacts are at %q, want %q", build.Artifacts, want)
+		}
+		if len(build.Manifest) != 1 || build.Manifest[0].Path != "skipped.txt" {
+			t.Errorf("build's manifest is %+v, want just skipped.txt", build.Manifest)
+		}
+		if slow := state.Executions["slow"]; slow.Artifacts != "" || len(slow.Manifest) != 0 {
+			t.Errorf("slow has artifacts %q with manifest %+v, want none", slow.Artifacts, slow.Manifest)
+		}
+		if got := w.cloud.Build(state.Executions["slow"].Build).Status; got != "CANCELLED" {
+			t.Errorf("slow build is %s, want CANCELLED", got)
+		}
+	},
+}, {
+	// gate waits for approval, and other keeps the workflow from ending once
+	// it is given.
+	name: "approve",
+	config: `
+exec: build() succeed.yaml
+wait: gate(build) -
+exec: deploy(gate) succeed.yaml
+exec: other() fail.yaml
+`,
+	during: func(t *testing.T, w *testWorkflow) {
+		waitForState(w.ctx, t, w.e, w.id, func(state *workflow.State) bool {
+			return state.Status("build") == workflow.StatusSucceeded && state.Status("other") == workflow.StatusFailed
+		})
+		var out bytes.Buffer
+		if err := describe(w.ctx, w.e, w.id, "json", &out); err != nil {
+			t.Fatalf("describe: %v", err)
+		}
+		var descs []executionDescription
+		if err := json.Unmarshal(out.Bytes(), &descs); err != nil {
+			t.Fatalf("could not decode %q: %v", out.String(), err)
+		}
+		if got := descs[1].Status; got != workflow.StatusAwaitingApproval {
+			t.Errorf("gate is %s before it is approved, want %s", got, workflow.StatusAwaitingApproval)
+		}
+		if w.ev.index("ran:deploy") != -1 {
+			t.Errorf("deploy ran before gate was approved")
+		}
+
+		if err := approve(w.ctx, w.e, w.id, "build", ""); err == nil {
+			t.Errorf("approved build, which is not a wait execution")
+		}
+		if err := approve(w.ctx, w.e, w.id, "gate", "looks good"); err != nil {
+			t.Fatalf("approve: %v", err)
+		}
+		waitForState(w.ctx, t, w.e, w.id, func(state *workflow.State) bool {
+			return state.Status("gate") == workflow.StatusSucceeded
+		})
+		if err := approve(w.ctx, w.e, w.id, "gate", ""); err == nil {
+			t.Errorf("approved gate twice")
+		}
+	},
+	wait:  "failed executions: other",
+	coord: "WORKING",
+	order: [][2]string{
+		{"completed:build", "ran:deploy"},
+	},
+	statuses: map[string]workflow.Status{
+		"gate":   workflow.StatusSucceeded,
+		"deploy": workflow.StatusSucceeded,
+	},
+	check: func(t *testing.T, w *testWorkflow, state *workflow.State) {
+		gate := state.Executions["gate"]
+		if a := gate.Approval; a == nil || a.By != w.e.account || a.At == "" || a.Comment != "looks good" {
+			t.Errorf("gate has approval %+v, want one by %s with a time and comment", a, w.e.account)
+		}
+		if gate.Build != "" {
+			t.Errorf("gate has build %s", gate.Build)
+		}
+	},
+}, {
+	name: "lazy",
+	config: `
+exec: build() succeed.yaml
+exec: test(build as bin) {
+  steps:
+  - name: 'ubuntu'
+    entrypoint: 'true'
+}
+`,
+	opts:  workflow.Options{Scheduling: workflow.SchedulingLazy},
+	coord: "SUCCESS",
+	statuses: map[string]workflow.Status{
+		"build": workflow.StatusSucceeded,
+		"test":  workflow.StatusSucceeded,
+	},
+	check: func(t *testing.T, w *testWorkflow, state *workflow.State) {
+		// test was only created once build completed, so it has nothing
+		// to wait for.
+		b := w.cloud.Build(state.Executions["test"].Build)
+		if b == nil {
+			t.Fatalf("test has no build: %+v", state.Executions["test"])
+		}
+		if got, want := b.Steps[0].Args, []string{"--completed=build:bin", workflow.ArtifactsPrefix(fakeProject, w.id), w.id, ""}; !reflect.DeepEqual(got, want) {
+			t.Errorf("test's wait step has args %q, want %q", got, want)
+		}
+		for _, s := range w.cloud.Subscriptions() {
+			if s != workflow.CoordSubscriptionName(fakeProject, w.id) {
+				t.Errorf("got subscription %s, want only coord's", s)
+			}
+		}
+	},
+}, {
+	name: "dynamic",
+	config: `
+exec: discover() discover.yaml
+exec: report(discover) succeed.yaml
+`,
+	bash:  true,
+	coord: "SUCCESS",
+	order: [][2]string{
+		{"completed:report", "ran:deploy_b"},
+	},
+	statuses: map[string]workflow.Status{
+		"deploy_a": workflow.StatusSucceeded,
+		"deploy_b": workflow.StatusSucceeded,
+	},
+	check: func(t *testing.T, w *testWorkflow, state *workflow.State) {
+		if got, want := state.Executions["discover"].Emitted, []string{"deploy_a", "deploy_b"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("discover emitted %q, want %q", got, want)
+		}
+		for _, name := range []string{"deploy_a", "deploy_b"} {
+			if ex := state.Executions[name]; ex != nil && ex.EmittedBy != "discover" {
+				t.Errorf("%s was emitted by %q, want discover", name, ex.EmittedBy)
+			}
+		}
+	},
+}, {
+	name: "params",
+	config: `
+param: region = us-central1
+param: env
+exec: deploy[tier=web]() succeed.yaml
+`,
+	opts:  workflow.Options{Params: map[string]string{"env": "dev"}},
+	coord: "SUCCESS",
+	statuses: map[string]workflow.Status{
+		"deploy-web": workflow.StatusSucceeded,
+	},
+	check: func(t *testing.T, w *testWorkflow, state *workflow.State) {
+		cfg, err := config.Load(state.Config.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := start(w.ctx, w.e, cfg, workflow.Options{}); err == nil || !strings.Contains(err.Error(), "env") {
+			t.Errorf("started without env: %v", err)
+		}
+		b := w.cloud.Build(state.Executions["deploy-web"].Build)
+		if b == nil {
+			t.Fatalf("deploy-web has no build: %+v", state.Executions["deploy-web"])
+		}
+		want := map[string]string{
+			"_REGION":           "us-central1",
+			"_ENV":              "dev",
+			"_TIER":             "web",
+			"_WORKFLOW_ID":      w.id,
+			"_EXECUTION_NAME":   "deploy-web",
+			"_ARTIFACTS_PREFIX": workflow.ArtifactsPrefix(fakeProject, w.id),
+		}
+		if !reflect.DeepEqual(b.Substitutions, want) {
+			t.Errorf("got substitutions %v, want %v", b.Substitutions, want)
+		}
+	},
+}, {
+	name: "conditions",
+	config: `
+param: env
+exec: build() fail.yaml
+exec: notify(build) if failure(build) succeed.yaml
+exec: cleanup(build) if success(build) succeed.yaml
+exec: deploy_prod(notify) if param.env == "prod" succeed.yaml
+exec: announce(deploy_prod) succeed.yaml
+`,
+	opts: workflow.Options{
+		UpstreamFailure: workflow.UpstreamFailureFail,
+		Params:          map[string]string{"env": "dev"},
+	},
+	wait:  "failed executions: build",
+	coord: "FAILURE",
+	statuses: map[string]workflow.Status{
+		"build":       workflow.StatusFailed,
+		"notify":      workflow.StatusSucceeded,
+		"cleanup":     workflow.StatusSkipped,
+		"deploy_prod": workflow.StatusSkipped,
+		"announce":    workflow.StatusSucceeded,
+	},
+	check: func(t *testing.T, w *testWorkflow, state *workflow.State) {
+		// Only the executions that ran have builds.
+		for _, name := range []string{"cleanup", "deploy_prod"} {
+			if b := state.Executions[name].Build; b != "" {
+				t.Errorf("%s has build %s", name, b)
+			}
+		}
+	},
+}, {
+	name: "retries",
+	config: `
+exec: flaky() retries=2 backoff=1s flaky.yaml
+exec: after(flaky) succeed.yaml
+`,
+	opts:  workflow.Options{UpstreamFailure: workflow.UpstreamFailureFail},
+	bash:  true,
+	coord: "SUCCESS",
+	statuses: map[string]workflow.Status{
+		"flaky": workflow.StatusSucceeded,
+		"after": workflow.StatusSucceeded,
+	},
+	check: func(t *testing.T, w *testWorkflow, state *workflow.State) {
+		flaky := state.Executions["flaky"]
+		if len(flaky.Attempts) != 3 {
+			t.Fatalf("got attempts %+v, want 3", flaky.Attempts)
+		}
+		for i, want := range []string{"FAILURE", "FAILURE", ""} {
+			if got := flaky.Attempts[i].Reason; got != want {
+				t.Errorf("attempt %d ended with %q, want %q", i+1, got, want)
+			}
+		}
+	},
+}, {
+	name: "execution timeout",
+	config: `
+exec: slow() timeout=1s slow.yaml
+exec: after(slow) succeed.yaml
+`,
+	opts:  workflow.Options{UpstreamFailure: workflow.UpstreamFailureFail},
+	wait:  "failed executions: slow",
+	coord: "FAILURE",
+	statuses: map[string]workflow.Status{
+		"slow": workflow.StatusFailed,
+	},
+	check: func(t *testing.T, w *testWorkflow, state *workflow.State) {
+		checkTimeout(t, w, state, false)
+	},
+}, {
+	// Cloudbuild cannot tell how long the build waits, so the timeout is
+	// left to coord.
+	name: "execution with dependencies timeout",
+	config: `
+exec: first() succeed.yaml
+exec: slow(first) timeout=1s slow.yaml
+exec: after(slow) succeed.yaml
+`,
+	opts:  workflow.Options{UpstreamFailure: workflow.UpstreamFailureFail},
+	wait:  "failed executions: slow",
+	coord: "FAILURE",
+	statuses: map[string]workflow.Status{
+		"slow": workflow.StatusFailed,
+	},
+	check: func(t *testing.T, w *testWorkflow, state *workflow.State) {
+		checkTimeout(t, w, state, false)
+	},
+}, {
+	name: "workflow timeout",
+	config: `
+exec: slow() slow.yaml
+exec: after(slow) succeed.yaml
+`,
+	opts:  workflow.Options{Timeout: 2 * time.Second},
+	wait:  "workflow timed out",
+	coord: "FAILURE",
+	statuses: map[string]workflow.Status{
+		"slow": workflow.StatusFailed,
+	},
+	check: func(t *testing.T, w *testWorkflow, state *workflow.State) {
+		checkTimeout(t, w, state, true)
+	},
+}, {
+	name: "cancel",
+	config: `
+exec: slow() slow.yaml
+exec: after(slow) succeed.yaml
+`,
+	during: func(t *testing.T, w *testWorkflow) {
+		waitForState(w.ctx, t, w.e, w.id, func(state *workflow.State) bool {
+			return state.Executions["slow"].Unblocked
+		})
+		if err := cancel(w.ctx, w.e, w.id); err != nil {
+			t.Fatalf("cancel: %v", err)
+		}
+	},
+	wait:  errCancelled.Error(),
+	coord: "CANCELLED",
+	check: func(t *testing.T, w *testWorkflow, state *workflow.State) {
+		for _, name := range []string{"slow", "after"} {
+			if got := waitForCoord(t, w.cloud, state.Executions[name].Build); got != "CANCELLED" {
+				t.Errorf("%s build is %s, want CANCELLED", name, got)
+			}
+		}
+		if topics := w.cloud.Topics(); len(topics) != 0 {
+			t.Errorf("got topics %v, want none", topics)
+		}
+		if subscriptions := w.cloud.Subscriptions(); len(subscriptions) != 0 {
+			t.Errorf("got subscriptions %v, want none", subscriptions)
+		}
+		if !state.Cancelled || !state.Over() {
+			t.Errorf("got cancelled %t and over %t, want both", state.Cancelled, state.Over())
+		}
+		if err := cancel(w.ctx, w.e, w.id); err == nil {
+			t.Errorf("cancelling again: got no error")
+		}
+	},
+}, {
+	name: "gc",
+	config: `
+exec: build() succeed.yaml
+`,
+	coord: "SUCCESS",
+	check: checkGC,
+}, {
+	name: "list",
+	config: `
+exec: build() succeed.yaml
+`,
+	coord: "SUCCESS",
+	check: checkList,
+}}
+
+func TestWorkflows(t *testing.T) {
+	for _, tc := range workflowTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if tc.short && testing.Short() {
+				t.Skip("skipped with -short")
+			}
+			if _, err := exec.LookPath("bash"); tc.bash && err != nil {
+				t.Skip("the builds need bash")
+			}
+			ctx := context.Background()
+			e, cloud, ev := newFakeEnv(ctx, t)
+			defer cloud.Close()
+			w := &testWorkflow{
+				ctx:   ctx,
+				e:     e,
+				cloud: cloud,
+				ev:    ev,
+			}
+			defer func() {
+				for _, dir := range w.dirs {
+					os.RemoveAll(dir)
+				}
+			}()
+
+			if tc.path != "" {
+				w.id = w.startFrom(t, tc.path, tc.opts)
+			} else {
+				w.id = w.start(t, tc.config, tc.opts)
+			}
+			if tc.during != nil {
+				tc.during(t, w)
+			}
+			if err := waitWorkflow(ctx, e, w.id); !waitCameTo(err, tc.wait) {
+				t.Fatalf("wait: got %v, want %q", err, tc.wait)
+			}
+			// wait leaves none of its subscriptions behind, even when
+			// coord is still around to keep the topic.
+			waitPrefix := workflow.SubscriptionName(fakeProject, workflow.WaitSubscriptionPrefix(w.id))
+			for _, s := range cloud.Subscriptions() {
+				if strings.HasPrefix(s, waitPrefix) {
+					t.Errorf("wait left subscription %s", s)
+				}
+			}
+			coord := cloud.Build(w.id).Status
+			if tc.coord != "WORKING" {
+				coord = waitForCoord(t, cloud, w.id)
+			}
+			if coord != tc.coord {
+				t.Errorf("coord build is %s, want %s", coord, tc.coord)
+			}
+
+			for _, o := range tc.order {
+				b, a := ev.index(o[0]), ev.index(o[1])
+				if b == -1 || a == -1 || b > a {
+					t.Errorf("want %s before %s, got %q", o[0], o[1], ev.list)
+				}
+			}
+			// A parked workflow's coord build takes a moment to record
+			// what became of everything.
+			state := waitForState(ctx, t, e, w.id, func(state *workflow.State) bool {
+				for name, want := range tc.statuses {
+					if state.Status(name) != want {
+						return false
+					}
+				}
+				return true
+			})
+			for name, want := range tc.statuses {
+				if got := state.Status(name); got != want {
+					t.Errorf("%s is %s, want %s", name, got, want)
+				}
+			}
+			// Joining the workflow once it has finished comes to the same
+			// thing, from what was recorded of it.
+			if err := w.rejoin(); !waitCameTo(err, tc.wait) {
+				t.Errorf("waiting again: got %v, want %q", err, tc.wait)
+			}
+			if tc.check != nil {
+				tc.check(t, w, state)
+			}
+		})
+	}
+}
+
+// waitCameTo is true if flargo wait returned err, when it should have
+// returned an error that reads want, or nil if want is empty.
+func waitCameTo(err error, want string) bool {
+	if err == nil {
+		return want == ""
+	}
+	return err.Error() == want
+}
+
+// checkDescribe checks the table and the JSON that describe writes for a
+// workflow parked on a failure that was retried.
+func checkDescribe(t *testing.T, w *testWorkflow, state *workflow.State) {
+	defer cancel(w.ctx, w.e, w.id)
+	state = waitForState(w.ctx, t, w.e, w.id, func(state *workflow.State) bool {
+		return state.Result != ""
+	})
+
+	var table bytes.Buffer
+	if err := describe(w.ctx, w.e, w.id, "table", &table); err != nil {
+		t.Fatalf("describe: %v", err)
+	}
+	// Each row has the name, build, attempt, status and what blocks it.
+	rows := map[string][]string{}
+	for _, line := range strings.Split(table.String(), "\n")[1:] {
+		if fields := strings.Fields(line); len(fields) == 8 {
+			rows[fields[0]] = fields[2:5]
+		}
+	}
+	for name, want := range map[string][]string{
+		"build":  {"2", "failed", "-"},
+		"lint":   {"1", "succeeded", "-"},
+		"test":   {"1", "blocked", "build"},
+		"deploy": {"1", "blocked", "test"},
+	} {
+		if got := rows[name]; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s row has %q, want %q in:\n%s", name, got, want, table.String())
+		}
+	}
+	build := state.Executions["build"]
+	for _, want := range []string{
+		fmt.Sprintf("build attempt 1 was build %s, which ended with FAILURE", build.Attempts[0].Build),
+		"build failed with FAILURE",
+	} {
+		if !strings.Contains(table.String(), want) {
+			t.Errorf("describe does not have %q:\n%s", want, table.String())
+		}
+	}
+
+	var out bytes.Buffer
+	if err := describe(w.ctx, w.e, w.id, "json", &out); err != nil {
+		t.Fatalf("describe: %v", err)
+	}
+	var descs []map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &descs); err != nil {
+		t.Fatalf("could not decode %q: %v", out.String(), err)
+	}
+	var names []string
+	for _, d := range descs {
+		names = append(names, fmt.Sprint(d["name"]))
+	}
+	if want := []string{"build", "lint", "test", "deploy"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("described %q, want %q", names, want)
+	}
+	wantBuild := map[string]interface{}{
+		"name":   "build",
+		"type":   "exec",
+		"build":  build.Build,
+		"status": "failed",
+		"reason": "FAILURE",
+		"attempts": []interface{}{
+			map[string]interface{}{"number": 1.0, "build": build.Attempts[0].Build, "reason": "FAILURE"},
+			map[string]interface{}{"number": 2.0, "build": build.Build, "reason": "FAILURE"},
+		},
+		"artifacts": workflow.ArtifactsPrefix(fakeProject, w.id) + "/build",
+	}
+	got := descs[0]
+	for _, times := range []string{"startTime", "finishTime"} {
+		if _, ok := got[times]; !ok {
+			t.Errorf("build has no %s", times)
+		}
+		delete(got, times)
+	}
+	if !reflect.DeepEqual(got, wantBuild) {
+		t.Errorf("got build %v, want %v", got, wantBuild)
+	}
+	if got := descs[3]["blockedBy"]; !reflect.DeepEqual(got, []interface{}{"test"}) {
+		t.Errorf("deploy is blocked by %v, want [test]", got)
+	}
+}
+
+// checkUpstreamFailure checks that the workflow failed, and that the builds
+// blocked by the failure have the given status.
+func checkUpstreamFailure(t *testing.T, w *testWorkflow, state *workflow.State, blocked string) {
+	if got := state.Executions["build"].Reason; got != "FAILURE" {
+		t.Errorf("build failed with %q, want FAILURE", got)
+	}
+	for _, name := range []string{"test", "deploy"} {
+		if got := w.cloud.Build(state.Executions[name].Build).Status; got != blocked {
+			t.Errorf("%s build is %s, want %s", name, got, blocked)
+		}
+	}
+	state = waitForState(w.ctx, t, w.e, w.id, func(state *workflow.State) bool {
+		return state.Result != ""
+	})
+	if state.Result != workflow.StatusFailed {
+		t.Errorf("workflow result is %q, want %s", state.Result, workflow.StatusFailed)
+	}
+}
+
+// checkTimeout checks that slow was cancelled for running out of time, and
+// whether the whole workflow did.
+func checkTimeout(t *testing.T, w *testWorkflow, state *workflow.State, workflowTimeout bool) {
+	if state.TimedOut != workflowTimeout {
+		t.Errorf("got timed out %t, want %t", state.TimedOut, workflowTimeout)
+	}
+	slow := state.Executions["slow"]
+	if slow.Reason != workflow.ReasonTimeout {
+		t.Errorf("slow failed with %q, want %s", slow.Reason, workflow.ReasonTimeout)
+	}
+	if status := w.cloud.Build(slow.Build).Status; status != "CANCELLED" {
+		t.Errorf("slow build is %s, want CANCELLED", status)
+	}
+}
+
+// checkGC checks what gc deletes once the workflow has succeeded, and that it
+// leaves a parked workflow alone until its coord build ends.
+func checkGC(t *testing.T, w *testWorkflow, state *workflow.State) {
+	ctx, e, cloud := w.ctx, w.e, w.cloud
+	// Coord cleans up after itself, and wait after itself.
+	if topics := cloud.Topics(); len(topics) != 0 {
+		t.Errorf("got topics %v after the workflow, want none", topics)
+	}
+	if subscriptions := cloud.Subscriptions(); len(subscriptions) != 0 {
+		t.Errorf("got subscriptions %v after the workflow, want none", subscriptions)
+	}
+	// Waiting once it is over still gets the result.
+	if err := waitWorkflow(ctx, e, w.id); err != nil {
+		t.Errorf("wait after the workflow: %v", err)
+	}
+
+	// What is left of a workflow whose coord build is gone, a subscription
+	// whose topic was deleted, and a topic that only looks like flargo's.
+	for _, gone := range []string{"gone", "deleted", "foo"} {
+		if _, err := e.pubsub.Projects.Topics.Create(workflow.TopicName(fakeProject, gone), &v1pubsub.Topic{}).Context(ctx).Do(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := workflow.WriteManifest(ctx, e.storage, fakeProject, &workflow.Manifest{WorkflowID: "gone"}); err != nil {
+		t.Fatal(err)
+	}
+	for sname, topic := range map[string]string{
+		"coord-gone":    "gone",
+		"coord-deleted": "deleted",
+		"foo-listener":  "foo",
+	} {
+		if _, err := e.pubsub.Projects.Subscriptions.Create(workflow.SubscriptionName(fakeProject, sname), &v1pubsub.Subscription{
+			Topic: workflow.TopicName(fakeProject, topic),
+		}).Context(ctx).Do(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := e.pubsub.Projects.Topics.Delete(workflow.TopicName(fakeProject, "deleted")).Context(ctx).Do(); err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := workflow.ArtifactsBucket(fakeProject)
+	artifacts := len(cloud.Objects(bucket, w.id+"/"))
+	if artifacts == 0 {
+		t.Fatal("the workflow left no artifacts")
+	}
+	for _, tc := range []struct {
+		name              string
+		olderThan         time.Duration
+		artifactRetention time.Duration
+		dryRun            bool
+		topics            int
+		subscriptions     int
+		artifacts         int
+	}{{
+		name:              "dry run",
+		artifactRetention: time.Nanosecond,
+		dryRun:            true,
+		topics:            2,
+		subscriptions:     3,
+		artifacts:         artifacts,
+	}, {
+		name:          "keep artifacts",
+		olderThan:     time.Hour,
+		topics:        1,
+		subscriptions: 1,
+		artifacts:     artifacts,
+	}, {
+		name:              "recent artifacts",
+		olderThan:         time.Hour,
+		artifactRetention: time.Hour,
+		topics:            1,
+		subscriptions:     1,
+		artifacts:         artifacts,
+	}, {
+		name:              "old artifacts",
+		olderThan:         time.Hour,
+		artifactRetention: time.Nanosecond,
+		topics:            1,
+		subscriptions:     1,
+	}} {
+		if err := gc(ctx, e, tc.olderThan, tc.artifactRetention, tc.dryRun); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got := len(cloud.Topics()); got != tc.topics {
+			t.Errorf("%s: got %d topics, want %d", tc.name, got, tc.topics)
+		}
+		if got := len(cloud.Subscriptions()); got != tc.subscriptions {
+			t.Errorf("%s: got %d subscriptions, want %d", tc.name, got, tc.subscriptions)
+		}
+		if got := len(cloud.Objects(bucket, w.id+"/")); got != tc.artifacts {
+			t.Errorf("%s: got %d artifacts, want %d", tc.name, got, tc.artifacts)
+		}
+	}
+
+	// A workflow parked on a failure is left alone until its coord build
+	// ends, which cancelling it stands in for timing out.
+	parked := w.start(t, `
+exec: build() fail.yaml
+`, workflow.Options{})
+	waitForState(ctx, t, e, parked, func(state *workflow.State) bool {
+		return state.Result == workflow.StatusFailed
+	})
+	for _, coordDone := range []bool{false, true} {
+		if coordDone {
+			if err := e.executions.CancelBuild(ctx, parked); err != nil {
+				t.Fatal(err)
+			}
+			waitForCoord(t, cloud, parked)
+		}
+		if err := gc(ctx, e, 0, time.Nanosecond, false); err != nil {
+			t.Fatalf("parked, coord done %t: %v", coordDone, err)
+		}
+		// foo's topic is never collected.
+		topics, artifacts := len(cloud.Topics())-1, len(cloud.Objects(bucket, parked+"/"))
+		if (topics == 0) != coordDone || (artifacts == 0) != coordDone {
+			t.Errorf("parked, coord done %t: got %d topics and %d artifacts left", coordDone, topics, artifacts)
+		}
+	}
+}
+
+// checkList starts a workflow that keeps running and one that is parked on a
+// failure, and checks how they are listed alongside the one that succeeded.
+func checkList(t *testing.T, w *testWorkflow, state *workflow.State) {
+	ctx, e := w.ctx, w.e
+	finished := w.id
+	if got, want := w.cloud.Build(state.Executions["build"].Build).Tags, workflow.ExecutionTags(finished, "build"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got execution build tags %q, want %q", got, want)
+	}
+
+	running := w.start(t, `
+exec: build() slow.yaml
+`, workflow.Options{})
+	defer cancel(ctx, e, running)
+	parked := w.start(t, `
+exec: build() fail.yaml
+`, workflow.Options{})
+	// A failure parks the workflow, so its coord build keeps going.
+	defer cancel(ctx, e, parked)
+	waitForState(ctx, t, e, parked, func(state *workflow.State) bool {
+		return state.Result == workflow.StatusFailed
+	})
+
+	for _, tc := range []struct {
+		name   string
+		status string
+		until  time.Duration
+		want   []string
+	}{{
+		name: "all",
+		want: []string{parked, running, finished},
+	}, {
+		name:   "running",
+		status: "running",
+		want:   []string{running},
+	}, {
+		name:   "failed",
+		status: "failed",
+		want:   []string{parked},
+	}, {
+		name:   "succeeded",
+		status: "succeeded",
+		want:   []string{finished},
+	}, {
+		name:  "until",
+		until: time.Hour,
+	}} {
+		var out bytes.Buffer
+		if err := list(ctx, e, tc.status, 24*time.Hour, tc.until, "json", &out); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		var descs []workflowDescription
+		if err := json.Unmarshal(out.Bytes(), &descs); err != nil {
+			t.Fatalf("%s: could not decode %q: %v", tc.name, out.String(), err)
+		}
+		var got []string
+		for _, d := range descs {
+			got = append(got, d.ID)
+			if d.Config != "test.wf" || d.StartedBy != e.account {
+				t.Errorf("%s: %s has config %q started by %q, want %q by %q", tc.name, d.ID, d.Config, d.StartedBy, "test.wf", e.account)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got workflows %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestOutcome(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		msgs []workflow.Message
+		want string
+	}{{
+		name: "succeeded",
+		msgs: []workflow.Message{{Completed: "build", Status: workflow.StatusSucceeded}},
+	}, {
+		name: "failed",
+		msgs: []workflow.Message{{Failed: "build", Status: workflow.StatusFailed}},
+		want: "failed executions: build",
+	}, {
+		name: "timed out",
+		msgs: []workflow.Message{{Failed: "build", Status: workflow.StatusFailed, Reason: workflow.ReasonTimeout}, {Result: workflow.StatusFailed, Reason: workflow.ReasonTimeout}},
+		want: "workflow timed out",
+	}, {
+		name: "cancelled",
+		msgs: []workflow.Message{cancellation},
+		want: errCancelled.Error(),
+	}} {
+		cfg, err := config.Parse(strings.NewReader("exec: build() build.yaml\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		state := workflow.NewState()
+		state.Apply(workflow.Message{Config: cfg})
+		for _, m := range tc.msgs {
+			state.Apply(m)
+		}
+		if err := outcome(state); !waitCameTo(err, tc.want) {
+			t.Errorf("%s: got %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+// runLocal needs no docker daemon for wait executions, which are approved as
+// soon as their dependencies complete.
+func TestRunLocal(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "flargo-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", tmp)
+
+	cfg, err := config.Parse(strings.NewReader(`
+wait: build() -
+wait: test(build) -
+wait: notify(test) if failure(test) -
+wait: deploy(test) if success(test) -
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := runLocal(ctx, cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A build cancelled from outside flargo fails its execution in wait, unless the
+// execution has moved on to another attempt by the next check.
+func TestCheckBuilds(t *testing.T) {
+	ctx := context.Background()
+	e, cloud, _ := newFakeEnv(ctx, t)
+	defer cloud.Close()
+
+	submit := func() string {
+		buildID, err := e.executions.SubmitBuild(ctx, &v1cloudbuild.Build{
+			Steps: []*v1cloudbuild.BuildStep{{
+				Name:       "ubuntu",
+				Entrypoint: "sleep",
+				Args:       []string{"60"},
+			}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buildID
+	}
+	state := workflow.NewState()
+	for _, name := range []string{"cancelled", "retried"} {
+		buildID := submit()
+		state.Apply(workflow.Message{Started: name, Build: buildID, Attempt: 1})
+		if err := e.executions.CancelBuild(ctx, buildID); err != nil {
+			t.Fatal(err)
+		}
+		waitForCoord(t, cloud, buildID)
+	}
+
+	cancelled := map[string]bool{}
+	if err := checkBuilds(ctx, e.executions, state, cancelled); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"cancelled", "retried"} {
+		if got := state.Executions[name].Status; got != workflow.StatusRunning {
+			t.Errorf("%s is %s after the first check, want %s", name, got, workflow.StatusRunning)
+		}
+	}
+
+	next := submit()
+	defer e.executions.CancelBuild(ctx, next)
+	state.Apply(workflow.Message{Started: "retried", Build: next, Attempt: 2})
+	if err := checkBuilds(ctx, e.executions, state, cancelled); err != nil {
+		t.Fatal(err)
+	}
+	if ex := state.Executions["cancelled"]; ex.Status != workflow.StatusFailed || ex.Reason != workflow.ReasonCancelled {
+		t.Errorf("cancelled is %s with %q, want failed with %s", ex.Status, ex.Reason, workflow.ReasonCancelled)
+	}
+	if got := state.Executions["retried"].Status; got != workflow.StatusRunning {
+		t.Errorf("retried is %s, want %s", got, workflow.StatusRunning)
+	}
+}
@@ -0,0 +1,242 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	v1pubsub "google.golang.org/api/pubsub/v1"
+
+	"github.com/skelterjohn/flargo/executions"
+	"github.com/skelterjohn/flargo/workflow"
+)
+
+// waitWorkflow blocks until every execution in the workflow has either
+// completed or failed, and returns an error if any of them failed.
+func waitWorkflow(ctx context.Context, e *env, workflowID string) error {
+	// Subscribe before reading the coord log, so that nothing published in
+	// between is missed. Anything seen twice is harmless.
+	sname := fmt.Sprintf("%s%d", workflow.WaitSubscriptionPrefix(workflowID), time.Now().UnixNano())
+	subscription := workflow.SubscriptionName(e.projectID, sname)
+	if _, err := e.pubsub.Projects.Subscriptions.Create(subscription, &v1pubsub.Subscription{
+		Name:  sname,
+		Topic: workflow.TopicName(e.projectID, workflowID),
+	}).Context(ctx).Do(); err != nil {
+		return overOr(ctx, e, workflowID, fmt.Errorf("could not subscribe to workflow: %v", err))
+	}
+	defer func() {
+		if _, err := e.pubsub.Projects.Subscriptions.Delete(subscription).Context(ctx).Do(); err != nil {
+			log.Printf("Could not delete subscription %q: %v", subscription, err)
+		}
+	}()
+
+	// Coord records each message a while after it is published, so what was
+	// published just before the subscription may not be in the event log
+	// yet. An empty message of wait's own marks how far coord has got, and
+	// nothing is decided from the state until it has been recorded.
+	marker, err := publishMarker(ctx, e, workflowID)
+	if err != nil {
+		return overOr(ctx, e, workflowID, err)
+	}
+	state, err := loadState(ctx, e, workflowID)
+	if err != nil {
+		return err
+	}
+
+	settled := false
+	var seen []workflow.Message
+	cancelled := map[string]bool{}
+	for !settled || !state.Finished() && !state.Stopped() {
+		resp, err := e.pubsub.Projects.Subscriptions.Pull(subscription, &v1pubsub.PullRequest{
+			MaxMessages: 10,
+		}).Context(ctx).Do()
+		if err != nil {
+			// flargo cancel deletes the subscription, perhaps before the
+			// cancellation was pulled from it.
+			return overOr(ctx, e, workflowID, fmt.Errorf("could not pull from subscription: %v", err))
+		}
+		for _, rmsg := range resp.ReceivedMessages {
+			if _, err := e.pubsub.Projects.Subscriptions.Acknowledge(subscription, &v1pubsub.AcknowledgeRequest{
+				AckIds: []string{rmsg.AckId},
+			}).Context(ctx).Do(); err != nil {
+				log.Printf("Could not ack %q: %v", rmsg.AckId, err)
+			}
+			m, err := workflow.DecodeMessage(rmsg.Message.Data)
+			if err != nil {
+				log.Printf("Could not decode message: %v", err)
+				continue
+			}
+			if m.Completed != "" {
+				log.Printf("%q completed", m.Completed)
+			}
+			if m.Failed != "" {
+				log.Printf("%q failed with %s", m.Failed, m.Reason)
+			}
+			if m.Retrying != "" {
+				log.Printf("%q attempt %d failed with %s, retrying at %s", m.Retrying, m.Attempt, m.Reason, m.RetryAt)
+			}
+			seen = append(seen, m)
+			state.Apply(m)
+			if m.Result != "" {
+				log.Printf("Workflow %s", m.Result)
+				// Coord recorded everything it based the result on,
+				// including what was published before this
+				// subscription existed.
+				if state, err = replay(ctx, e, workflowID, seen); err != nil {
+					return err
+				}
+			}
+		}
+		if !settled {
+			if settled, err = caughtUp(ctx, e, workflowID, marker); err != nil {
+				return err
+			}
+			if !settled {
+				continue
+			}
+			if state, err = replay(ctx, e, workflowID, seen); err != nil {
+				return err
+			}
+		}
+
+		// Failed builds never publish anything, so ask cloudbuild about them.
+		if err := checkBuilds(ctx, e.executions, state, cancelled); err != nil {
+			return err
+		}
+	}
+
+	return outcome(state)
+}
+
+// publishMarker publishes an empty message to the workflow's topic, and returns
+// its ID.
+func publishMarker(ctx context.Context, e *env, workflowID string) (string, error) {
+	data, err := workflow.EncodeMessage(workflow.Message{})
+	if err != nil {
+		return "", fmt.Errorf("could not encode message: %v", err)
+	}
+	resp, err := e.pubsub.Projects.Topics.Publish(workflow.TopicName(e.projectID, workflowID), &v1pubsub.PublishRequest{
+		Messages: []*v1pubsub.PubsubMessage{{
+			Data: data,
+		}},
+	}).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("could not publish to workflow: %v", err)
+	}
+	if len(resp.MessageIds) == 0 {
+		return "", errors.New("could not publish to workflow: no message ID")
+	}
+	return resp.MessageIds[0], nil
+}
+
+// caughtUp is true once coord has recorded the marker, or will never record
+// anything more.
+func caughtUp(ctx context.Context, e *env, workflowID, marker string) (bool, error) {
+	recorded, err := workflow.Recorded(ctx, e.storage, e.projectID, workflowID, marker)
+	if err != nil || recorded {
+		return recorded, err
+	}
+	status, err := e.executions.FetchBuildStatus(ctx, workflowID)
+	if err != nil {
+		return false, fmt.Errorf("could not get status of coord build %s: %v", workflowID, err)
+	}
+	return status == "SUCCESS" || executions.BuildFailed(status), nil
+}
+
+// replay loads the workflow's state, and applies the messages seen since the
+// subscription was made.
+func replay(ctx context.Context, e *env, workflowID string, seen []workflow.Message) (*workflow.State, error) {
+	state, err := loadState(ctx, e, workflowID)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range seen {
+		state.Apply(m)
+	}
+	return state, nil
+}
+
+// outcome is what waiting for the workflow comes to, once it is finished.
+func outcome(state *workflow.State) error {
+	if state.Cancelled {
+		return errCancelled
+	}
+	if state.TimedOut {
+		return errors.New("workflow timed out")
+	}
+	if failed := state.Failed(); len(failed) != 0 {
+		return fmt.Errorf("failed executions: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// errCancelled is what waiting for a cancelled workflow comes to.
+var errCancelled = errors.New("workflow cancelled")
+
+// overOr returns the workflow's outcome if it is over, since its topic goes
+// once it is, and otherwise err.
+func overOr(ctx context.Context, e *env, workflowID string, err error) error {
+	if state, lerr := loadState(ctx, e, workflowID); lerr == nil && state.Over() {
+		return outcome(state)
+	}
+	return err
+}
+
+// checkBuilds updates the state of every running execution from the status of
+// its build. A failed build with retries left is retrying rather than failed.
+// A cancelled build has failed if its execution is still running the next time
+// it is checked, since whoever cancelled it to retry, skip or time it out has
+// by then said what became of it. cancelled has the builds seen cancelled so
+// far.
+func checkBuilds(ctx context.Context, c executions.Client, state *workflow.State, cancelled map[string]bool) error {
+	for name, e := range state.Executions {
+		if e.Status != workflow.StatusRunning {
+			continue
+		}
+		status, err := c.FetchBuildStatus(ctx, e.Build)
+		if err != nil {
+			return fmt.Errorf("could not get status of %q build %s: %v", name, e.Build, err)
+		}
+		switch {
+		case status == "SUCCESS":
+			// The complete step is the last one, so the completion was published.
+			state.SetStatus(name, workflow.StatusSucceeded)
+		case status == "CANCELLED" && !cancelled[e.Build]:
+			cancelled[e.Build] = true
+		case status == "CANCELLED":
+			// Someone cancelled it on purpose, so it is not retried.
+			log.Printf("%q failed: build %s is %s", name, e.Build, status)
+			state.Apply(workflow.Message{
+				Failed:  name,
+				Status:  workflow.StatusFailed,
+				Reason:  status,
+				Build:   e.Build,
+				Attempt: e.Attempt(),
+			})
+		case executions.BuildFailed(status):
+			if m, ok := state.Retry(name, e.Attempt(), e.Build, status); ok {
+				log.Printf("%q attempt %d failed: build %s is %s, retrying at %s", name, m.Attempt, e.Build, status, m.RetryAt)
+				state.Apply(m)
+				continue
+			}
+			log.Printf("%q failed: build %s is %s", name, e.Build, status)
+			state.SetStatus(name, workflow.StatusFailed)
+		}
+	}
+	return nil
+}
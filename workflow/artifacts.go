@@ -0,0 +1,157 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package workflow
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	"google.golang.org/api/iterator"
+)
+
+// UploadArtifacts copies every file under dir to the bucket, with object names
+// beginning with prefix, and returns what it copied. Whatever was under prefix
+// before is removed, since a retry uploads where earlier attempts did.
+func UploadArtifacts(ctx context.Context, sc *storage.Client, bucket, prefix, dir string) ([]Artifact, error) {
+	if err := deleteArtifacts(ctx, sc, bucket, prefix); err != nil {
+		return nil, err
+	}
+	var manifest []Artifact
+	err := filepath.Walk(dir, func(localPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		relpath, err := filepath.Rel(dir, localPath)
+		if err != nil {
+			return fmt.Errorf("could not get relative path from %q to %q", dir, localPath)
+		}
+		objName := path.Join(prefix, filepath.ToSlash(relpath))
+
+		fin, err := os.Open(localPath)
+		if err != nil {
+			return fmt.Errorf("could not open artifact %q: %v", relpath, err)
+		}
+		defer fin.Close()
+
+		w := sc.Bucket(bucket).Object(objName).NewWriter(ctx)
+		h := md5.New()
+		n, err := io.Copy(io.MultiWriter(w, h), fin)
+		if err != nil {
+			w.Close()
+			return fmt.Errorf("could not upload artifact %q: %v", relpath, err)
+		}
+		if err := w.Close(); err != nil {
+			return fmt.Errorf("could not upload artifact %q: %v", relpath, err)
+		}
+		manifest = append(manifest, Artifact{
+			Path: filepath.ToSlash(relpath),
+			Size: n,
+			MD5:  hex.EncodeToString(h.Sum(nil)),
+		})
+		return nil
+	})
+	return manifest, err
+}
+
+// deleteArtifacts removes every object in the bucket whose name begins with
+// prefix.
+func deleteArtifacts(ctx context.Context, sc *storage.Client, bucket, prefix string) error {
+	it := sc.Bucket(bucket).Objects(ctx, &storage.Query{
+		Prefix: prefix + "/",
+	})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not list old artifacts: %v", err)
+		}
+		if err := sc.Bucket(bucket).Object(attrs.Name).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+			return fmt.Errorf("could not delete old artifact %q: %v", attrs.Name, err)
+		}
+	}
+}
+
+// DownloadArtifacts copies every object in the bucket whose name begins with
+// prefix to dir, the reverse of UploadArtifacts.
+func DownloadArtifacts(ctx context.Context, sc *storage.Client, bucket, prefix, dir string) error {
+	it := sc.Bucket(bucket).Objects(ctx, &storage.Query{
+		Prefix: prefix + "/",
+	})
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, 1)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			wg.Wait()
+			return err
+		}
+		wg.Add(1)
+		go func(objName string) {
+			defer wg.Done()
+			if err := downloadArtifact(ctx, sc, bucket, objName, filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(objName, prefix+"/")))); err != nil {
+				// Only the first error is returned.
+				select {
+				case errCh <- err:
+				default:
+				}
+			}
+		}(attrs.Name)
+	}
+	wg.Wait()
+	close(errCh)
+	return <-errCh
+}
+
+func downloadArtifact(ctx context.Context, sc *storage.Client, bucket, objName, localPath string) error {
+	r, err := sc.Bucket(bucket).Object(objName).NewReader(ctx)
+	if err != nil {
+		return fmt.Errorf("could not read object %q: %v", objName, err)
+	}
+	defer r.Close()
+
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return fmt.Errorf("could not create directory for artifact %q: %v", localPath, err)
+	}
+	fout, err := os.Create(localPath)
+	if err != nil {
+		return fmt.Errorf("could not create local artifact %q: %v", localPath, err)
+	}
+	if _, err := io.Copy(fout, r); err != nil {
+		fout.Close()
+		return fmt.Errorf("could not download artifact %q: %v", objName, err)
+	}
+	if err := fout.Close(); err != nil {
+		return fmt.Errorf("could not download artifact %q: %v", objName, err)
+	}
+	log.Printf("Downloaded %s to %s", objName, localPath)
+	return nil
+}
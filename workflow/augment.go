@@ -0,0 +1,125 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package workflow
+
+import (
+	"fmt"
+	"strings"
+
+	v1cloudbuild "google.golang.org/api/cloudbuild/v1"
+
+	"github.com/skelterjohn/flargo/config"
+	"github.com/skelterjohn/flargo/executions"
+)
+
+// AugmentBuild surrounds an execution's own steps with a wait step, which
+// blocks on its dependencies and fetches their artifacts, and a complete step,
+// which saves its artifacts and announces the completion of this attempt.
+// Dependencies in completed have already finished, so their artifacts are
+// fetched right away. If all of them have, the subscription is not used.
+// It also gives the build its substitutions, and its timeout if the execution
+// has one, which leaves room for the wait step to wait as long as the workflow
+// may run.
+func AugmentBuild(build *v1cloudbuild.Build, gcsPrefix, workflowID, subscription string, execution config.Execution, opts Options, attempt int, completed map[string]bool) {
+	var waitArgs []string
+	var done []string
+	var waitExecutions []string
+	for _, param := range execution.Params {
+		// The wait step puts the dependency's artifacts under its alias.
+		dep := param.Name + ":" + param.LocalName()
+		if completed[param.Name] {
+			done = append(done, dep)
+		} else {
+			waitExecutions = append(waitExecutions, dep)
+		}
+	}
+	if len(done) != 0 {
+		waitArgs = append(waitArgs, "--completed="+strings.Join(done, ","))
+	}
+	if opts.UpstreamFailure == UpstreamFailureFail {
+		waitArgs = append(waitArgs, "--upstream-failure="+string(opts.UpstreamFailure))
+	}
+	waitArgs = append(waitArgs, gcsPrefix, workflowID, subscription)
+	waitArgs = append(waitArgs, waitExecutions...)
+
+	build.Steps = append([]*v1cloudbuild.BuildStep{{
+		Name: executions.WaitImage,
+		Args: waitArgs,
+	}}, build.Steps...)
+	build.Steps = append(build.Steps,
+		&v1cloudbuild.BuildStep{
+			Name: executions.CompleteImage,
+			Args: []string{
+				gcsPrefix,
+				workflowID,
+				execution.Name,
+				"$BUILD_ID",
+				fmt.Sprint(attempt),
+			},
+		},
+	)
+
+	// Ensure that each step (including wait and complete) have access to the artifacts volume.
+	// The artifacts will be populated by wait, and will be copied out by complete.
+	for _, b := range build.Steps {
+		b.Volumes = append(b.Volumes, &v1cloudbuild.Volume{
+			Name: "workflow_artifacts",
+			Path: "/workflow_artifacts",
+		})
+	}
+
+	addSubstitutions(build, gcsPrefix, workflowID, execution, opts)
+	build.Tags = append(build.Tags, ExecutionTags(workflowID, execution.Name)...)
+
+	// Cloudbuild's timeout covers the wait step too, which may take any part
+	// of the workflow's time. So for an execution that waits, cloudbuild only
+	// stops a build that outlives the workflow, and it is coord that cancels
+	// one that runs for longer than its timeout once its dependencies are
+	// done.
+	if execution.Timeout != 0 {
+		timeout := execution.Timeout
+		if len(waitExecutions) != 0 {
+			wait := opts.Timeout
+			if wait == 0 {
+				wait = executions.MaxTimeout
+			}
+			timeout += wait
+		}
+		build.Timeout = executions.Timeout(timeout)
+	}
+}
+
+// addSubstitutions gives the build the workflow's params and the execution's
+// matrix values, which take precedence over the build's own substitutions, and
+// the values flargo sets for every build, which take precedence over those.
+func addSubstitutions(build *v1cloudbuild.Build, gcsPrefix, workflowID string, execution config.Execution, opts Options) {
+	if build.Substitutions == nil {
+		build.Substitutions = map[string]string{}
+	}
+	for k, v := range opts.Params {
+		build.Substitutions[config.SubstitutionKey(k)] = v
+	}
+	for k, v := range execution.Substitutions() {
+		build.Substitutions[k] = v
+	}
+	build.Substitutions["_WORKFLOW_ID"] = workflowID
+	build.Substitutions["_EXECUTION_NAME"] = execution.Name
+	build.Substitutions["_ARTIFACTS_PREFIX"] = gcsPrefix
+
+	// Few builds use every substitution, and cloudbuild otherwise refuses
+	// builds with substitutions they do not use.
+	if build.Options == nil {
+		build.Options = &v1cloudbuild.BuildOptions{}
+	}
+	build.Options.SubstitutionOption = "ALLOW_LOOSE"
+}
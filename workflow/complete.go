@@ -0,0 +1,115 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package workflow
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	v1pubsub "google.golang.org/api/pubsub/v1"
+)
+
+// CompleteUsage describes the arguments of the complete step.
+const CompleteUsage = "complete GCS_PREFIX WORKFLOW_ID EXECUTION BUILD_ID ATTEMPT"
+
+// A Completer does the work of the complete step, which ends every execution's
+// build. It uploads whatever the execution left in Artifacts/out, and
+// announces that the execution has completed, along with the executions of any
+// config fragment it left in out/flargo.wf.
+type Completer struct {
+	PubSub    *v1pubsub.Service
+	Storage   *storage.Client
+	ProjectID string
+	// Artifacts is where the build keeps its artifacts, /workflow_artifacts
+	// outside of tests.
+	Artifacts string
+
+	gcsPrefix  string
+	workflowID string
+	name       string
+	build      string
+	attempt    int
+}
+
+// ParseCompleter reads the complete step's arguments, as AugmentBuild writes
+// them.
+func ParseCompleter(args []string) (*Completer, error) {
+	if len(args) != 5 {
+		return nil, errors.New("wrong number of arguments")
+	}
+	if !strings.HasPrefix(args[0], "gs://") || !strings.Contains(strings.TrimPrefix(args[0], "gs://"), "/") {
+		return nil, fmt.Errorf("invalid GCS prefix %q", args[0])
+	}
+	attempt, err := strconv.Atoi(args[4])
+	if err != nil {
+		return nil, fmt.Errorf("invalid attempt %q", args[4])
+	}
+	return &Completer{
+		gcsPrefix:  args[0],
+		workflowID: args[1],
+		name:       args[2],
+		build:      args[3],
+		attempt:    attempt,
+	}, nil
+}
+
+// Run uploads the execution's artifacts and publishes its completion.
+func (c *Completer) Run(ctx context.Context) error {
+	m := Message{
+		Completed: c.name,
+		Status:    StatusSucceeded,
+		Artifacts: c.gcsPrefix + "/" + c.name,
+		Build:     c.build,
+		Attempt:   c.attempt,
+	}
+
+	tokens := strings.SplitN(strings.TrimPrefix(c.gcsPrefix, "gs://"), "/", 2)
+	bucket, object := tokens[0], tokens[1]
+	out := filepath.Join(c.Artifacts, "out")
+	if _, err := os.Stat(out); err == nil {
+		m.Manifest, err = UploadArtifacts(ctx, c.Storage, bucket, path.Join(object, c.name), out)
+		if err != nil {
+			return fmt.Errorf("could not upload artifacts: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("could not read artifacts: %v", err)
+	}
+	for _, a := range m.Manifest {
+		log.Printf("Uploaded %s (%d bytes, md5 %s)", a.Path, a.Size, a.MD5)
+	}
+
+	var err error
+	m.Emitted, m.EmittedBuilds, err = ReadFragment(ctx, c.Storage, c.ProjectID, c.workflowID, c.name, out)
+	if err != nil {
+		return fmt.Errorf("could not read config fragment: %v", err)
+	}
+	if m.Emitted != nil {
+		for _, ce := range m.Emitted.Executions {
+			log.Printf("Adding %q to the workflow", ce.Name)
+		}
+	}
+
+	if err := Publish(ctx, c.PubSub, TopicName(c.ProjectID, c.workflowID), m); err != nil {
+		return fmt.Errorf("could not publish completion: %v", err)
+	}
+	log.Printf("Completed %q attempt %d", c.name, c.attempt)
+	return nil
+}
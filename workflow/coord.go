@@ -0,0 +1,470 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package workflow
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	v1cloudbuild "google.golang.org/api/cloudbuild/v1"
+	v1pubsub "google.golang.org/api/pubsub/v1"
+
+	"github.com/skelterjohn/flargo/config"
+)
+
+// CoordSubscriptionName is the full name of the subscription the coord step
+// reads the workflow topic with. flargo start waits for it to exist before
+// publishing anything.
+func CoordSubscriptionName(projectID, workflowID string) string {
+	return SubscriptionName(projectID, "coord-"+workflowID)
+}
+
+// A Coordinator does the work of the coord step. It creates the workflow's
+// topic, records everything published on it in the event log, and keeps the
+// workflow's state from those messages. From the state it announces executions
+// as they are unblocked and the workflow's result once it has one. It also
+// watches the builds of executions so that their failures get published.
+// Under SchedulingLazy, it also creates the build of each execution once it is
+// unblocked, and it always does for executions with a condition, once it has
+// decided that they run. It retries failed builds that have retries left, and
+// fails those that run out of time.
+type Coordinator struct {
+	ProjectID  string
+	WorkflowID string
+	PubSub     *v1pubsub.Service
+	Storage    *storage.Client
+	// BuildStatus gets the cloudbuild status of a build.
+	BuildStatus func(ctx context.Context, buildID string) (string, error)
+	// Submit creates a build and returns its ID, and Cancel cancels one.
+	Submit func(ctx context.Context, build *v1cloudbuild.Build) (string, error)
+	Cancel func(ctx context.Context, buildID string) error
+	// Log gets each message as it is seen, one per line.
+	Log io.Writer
+
+	// pending has the IDs of messages coord published that it has not yet
+	// seen come back on its subscription, and so has not recorded.
+	pending map[string]bool
+	// manifest is read the first time coord creates a build from it.
+	manifest *Manifest
+	// clocks has, for each attempt at an execution with a timeout, when coord
+	// first saw it running with its dependencies done.
+	clocks map[string]time.Time
+}
+
+// Run coordinates the workflow until it is over, or until ctx is done. A
+// workflow that succeeds is over once that is recorded, and Run returns nil.
+// Under UpstreamFailureFail, a workflow that fails is over once the failures
+// of all its builds are recorded, and Run returns an error naming the
+// executions that failed. Under UpstreamFailurePark, a failed workflow may
+// still be retried, so Run keeps going.
+func (c *Coordinator) Run(ctx context.Context) error {
+	tname := TopicName(c.ProjectID, c.WorkflowID)
+	if _, err := c.PubSub.Projects.Topics.Create(tname, &v1pubsub.Topic{
+		Name: "workflow-" + c.WorkflowID,
+	}).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("could not create topic: %v", err)
+	}
+
+	sname := CoordSubscriptionName(c.ProjectID, c.WorkflowID)
+	if _, err := c.PubSub.Projects.Subscriptions.Create(sname, &v1pubsub.Subscription{
+		Name:  "coord-" + c.WorkflowID,
+		Topic: tname,
+	}).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("could not create subscription: %v", err)
+	}
+	log.Printf("Created topic %q", tname)
+
+	began := time.Now()
+	c.pending = map[string]bool{}
+	c.clocks = map[string]time.Time{}
+	state := NewState()
+	watcher := NewWatcher()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+		resp, err := c.PubSub.Projects.Subscriptions.Pull(sname, &v1pubsub.PullRequest{
+			MaxMessages: 10,
+		}).Context(ctx).Do()
+		if err != nil {
+			log.Printf("Error pulling subscription %q: %v", sname, err)
+			continue
+		}
+		for _, rmsg := range resp.ReceivedMessages {
+			m, err := c.handle(ctx, rmsg.Message)
+			if err != nil {
+				// Leave it to be delivered again.
+				log.Printf("Could not handle message %s: %v", rmsg.Message.MessageId, err)
+				continue
+			}
+			state.Apply(m)
+			watcher.Apply(m)
+			if _, err := c.PubSub.Projects.Subscriptions.Acknowledge(sname, &v1pubsub.AcknowledgeRequest{
+				AckIds: []string{rmsg.AckId},
+			}).Context(ctx).Do(); err != nil {
+				log.Printf("Failed to ack message %q: %v", rmsg.AckId, err)
+			}
+		}
+
+		// The failures come back around on the subscription, which puts
+		// them in the event log.
+		failures, err := watcher.Check(ctx, c.BuildStatus)
+		if err != nil {
+			log.Printf("Error checking builds: %v", err)
+		}
+		// An execution with retries left is retried instead, which its
+		// dependents never hear about. One cancelled from outside flargo
+		// was cancelled on purpose, so it is not.
+		for _, m := range failures {
+			name := m.Failed
+			if m.Reason == ReasonCancelled {
+				// If flargo cancelled it, whoever did has already said
+				// what became of it.
+				if !state.Current(name, m.Attempt) {
+					continue
+				}
+			} else if r, ok := state.Retry(name, m.Attempt, m.Build, m.Reason); ok {
+				m = r
+			}
+			if err := c.publish(ctx, tname, m); err != nil {
+				log.Printf("Could not publish failure of %q: %v", name, err)
+				continue
+			}
+			if m.Retrying != "" {
+				log.Printf("%q attempt %d failed with %s, retrying at %s", m.Retrying, m.Attempt, m.Reason, m.RetryAt)
+				state.Apply(m)
+			}
+		}
+
+		// Derived messages are applied as soon as they are published, so
+		// that they are only published once.
+		for _, m := range state.Derive() {
+			if err := c.publish(ctx, tname, m); err != nil {
+				log.Printf("Could not publish derived message: %v", err)
+				continue
+			}
+			state.Apply(m)
+			if m.Unblocked != "" {
+				log.Printf("Unblocked %q", m.Unblocked)
+			}
+			if m.Skipped {
+				log.Printf("Skipped %q, since its condition does not hold", m.Completed)
+			}
+			if m.Result != "" {
+				log.Printf("Workflow %s", m.Result)
+			}
+		}
+
+		if timeout := state.Options.Timeout; timeout != 0 && !state.Over() && time.Since(began) > timeout {
+			c.timeOutWorkflow(ctx, tname, state, watcher)
+		}
+		c.timeOut(ctx, tname, state, watcher)
+		c.schedule(ctx, tname, state, watcher)
+		c.retry(ctx, tname, state, watcher)
+
+		// Wait for everything published to be recorded, and for the
+		// builds still running to end.
+		if !state.Over() || len(c.pending) != 0 || !watcher.Idle() {
+			continue
+		}
+		c.cleanUp(ctx, tname)
+		if state.Cancelled {
+			return errors.New("workflow cancelled")
+		}
+		if state.Result == StatusFailed {
+			return fmt.Errorf("failed executions: %s", strings.Join(state.Failed(), ", "))
+		}
+		return nil
+	}
+}
+
+// cleanUp deletes the workflow's topic and the subscriptions to it, since
+// nothing more will be published. The subscriptions of flargo wait are left to
+// it, so that it can still pull the result.
+func (c *Coordinator) cleanUp(ctx context.Context, topic string) {
+	var subscriptions []string
+	if err := c.PubSub.Projects.Topics.Subscriptions.List(topic).Pages(ctx, func(resp *v1pubsub.ListTopicSubscriptionsResponse) error {
+		subscriptions = append(subscriptions, resp.Subscriptions...)
+		return nil
+	}); err != nil {
+		log.Printf("Could not list subscriptions of %q: %v", topic, err)
+		return
+	}
+	waitPrefix := SubscriptionName(c.ProjectID, WaitSubscriptionPrefix(c.WorkflowID))
+	for _, sname := range subscriptions {
+		if strings.HasPrefix(sname, waitPrefix) {
+			continue
+		}
+		if _, err := c.PubSub.Projects.Subscriptions.Delete(sname).Context(ctx).Do(); err != nil {
+			log.Printf("Could not delete subscription %q: %v", sname, err)
+		}
+	}
+	if _, err := c.PubSub.Projects.Topics.Delete(topic).Context(ctx).Do(); err != nil {
+		log.Printf("Could not delete topic %q: %v", topic, err)
+		return
+	}
+	log.Printf("Deleted topic %q and its subscriptions", topic)
+}
+
+// schedule creates the first attempt at each exec execution that is unblocked
+// and has not started, if coord is the one to create it. That is every
+// execution under SchedulingLazy, and otherwise only those added by a config
+// fragment, since flargo start never knew about them, and those with a
+// condition, since only coord can tell whether they run.
+func (c *Coordinator) schedule(ctx context.Context, topic string, state *State, watcher *Watcher) {
+	if state.Config == nil || state.Stopped() {
+		return
+	}
+	for _, ce := range state.Config.Executions {
+		e := state.Executions[ce.Name]
+		if state.Options.Scheduling != SchedulingLazy && e.EmittedBy == "" && ce.When == nil {
+			continue
+		}
+		if ce.Type != config.TypeExec || !e.Unblocked || e.Attempt() != 0 || e.Status.Done() || !state.Holds(ce.Name) {
+			continue
+		}
+		if err := c.start(ctx, topic, state, watcher, ce.Name, 1); err != nil {
+			log.Printf("Could not start %q: %v", ce.Name, err)
+		}
+	}
+}
+
+// retry creates the next attempt at each execution that is retrying, once its
+// backoff has passed.
+func (c *Coordinator) retry(ctx context.Context, topic string, state *State, watcher *Watcher) {
+	if state.Config == nil || state.Stopped() {
+		return
+	}
+	for _, ce := range state.Config.Executions {
+		e := state.Executions[ce.Name]
+		if e.Status != StatusRetrying {
+			continue
+		}
+		if at, err := time.Parse(time.RFC3339, e.RetryAt); err == nil && time.Now().Before(at) {
+			continue
+		}
+		if err := c.start(ctx, topic, state, watcher, ce.Name, e.Attempt()+1); err != nil {
+			log.Printf("Could not retry %q: %v", ce.Name, err)
+		}
+	}
+}
+
+// timeOut fails the latest attempt at each execution that has run for longer
+// than its timeout, or retries it if it has retries left. The time counts from
+// when coord first saw the attempt running with its dependencies done.
+func (c *Coordinator) timeOut(ctx context.Context, topic string, state *State, watcher *Watcher) {
+	if state.Config == nil {
+		return
+	}
+	for _, ce := range state.Config.Executions {
+		e := state.Executions[ce.Name]
+		if ce.Timeout == 0 || e.Status != StatusRunning || !e.Unblocked {
+			continue
+		}
+		key := fmt.Sprintf("%s/%d", ce.Name, e.Attempt())
+		since, ok := c.clocks[key]
+		if !ok {
+			c.clocks[key] = time.Now()
+			continue
+		}
+		if time.Since(since) < ce.Timeout {
+			continue
+		}
+		log.Printf("%q attempt %d ran for longer than %s", ce.Name, e.Attempt(), ce.Timeout)
+		m := Message{
+			Failed:  ce.Name,
+			Status:  StatusFailed,
+			Reason:  ReasonTimeout,
+			Build:   e.Build,
+			Attempt: e.Attempt(),
+		}
+		if r, ok := state.Retry(ce.Name, e.Attempt(), e.Build, ReasonTimeout); ok {
+			m = r
+		}
+		c.cancel(ctx, topic, state, watcher, e, m)
+	}
+}
+
+// timeOutWorkflow announces that the workflow timed out, and fails every
+// execution that has not finished. The result goes first, so that whoever is
+// waiting for the workflow knows why its executions failed. Blocked executions
+// are not failed, but their builds are cancelled, since nothing will unblock
+// them now.
+func (c *Coordinator) timeOutWorkflow(ctx context.Context, topic string, state *State, watcher *Watcher) {
+	log.Printf("Workflow ran for longer than %s", state.Options.Timeout)
+	m := Message{
+		Result: StatusFailed,
+		Reason: ReasonTimeout,
+	}
+	if err := c.publish(ctx, topic, m); err != nil {
+		log.Printf("Could not publish timeout: %v", err)
+	}
+	state.Apply(m)
+	blocked := map[string]bool{}
+	for _, ce := range state.Config.Executions {
+		blocked[ce.Name] = state.Blocked(ce.Name)
+	}
+	for _, ce := range state.Config.Executions {
+		e := state.Executions[ce.Name]
+		if e.Status.Terminal() {
+			continue
+		}
+		if blocked[ce.Name] {
+			// The watcher lets go of it once it sees the build
+			// cancelled, and the workflow being stopped says why.
+			if e.Build != "" && e.Status == StatusRunning {
+				if err := c.Cancel(ctx, e.Build); err != nil {
+					log.Printf("Could not cancel %q build %s: %v", ce.Name, e.Build, err)
+				}
+			}
+			continue
+		}
+		c.cancel(ctx, topic, state, watcher, e, Message{
+			Failed:  ce.Name,
+			Status:  StatusFailed,
+			Reason:  ReasonTimeout,
+			Build:   e.Build,
+			Attempt: e.Attempt(),
+		})
+	}
+}
+
+// cancel cancels the execution's latest build, if it has one, and publishes m
+// to say what became of it.
+func (c *Coordinator) cancel(ctx context.Context, topic string, state *State, watcher *Watcher, e *Execution, m Message) {
+	if e.Build != "" && e.Status == StatusRunning {
+		if err := c.Cancel(ctx, e.Build); err != nil {
+			log.Printf("Could not cancel %q build %s: %v", e.Name, e.Build, err)
+		}
+	}
+	if err := c.publish(ctx, topic, m); err != nil {
+		log.Printf("Could not publish timeout of %q: %v", e.Name, err)
+	}
+	state.Apply(m)
+	watcher.Apply(m)
+}
+
+// start creates an attempt at an execution whose dependencies are done, and
+// announces it.
+func (c *Coordinator) start(ctx context.Context, topic string, state *State, watcher *Watcher, name string, attempt int) error {
+	// Builds from the start of the workflow are in its manifest.
+	b, ok := state.Builds[name]
+	if !ok && c.manifest == nil {
+		manifest, err := ReadManifest(ctx, c.Storage, c.ProjectID, c.WorkflowID)
+		if err != nil {
+			return fmt.Errorf("could not read manifest: %v", err)
+		}
+		c.manifest = manifest
+	}
+	if !ok {
+		b, ok = c.manifest.Builds[name]
+	}
+	if !ok {
+		return fmt.Errorf("no build for %q", name)
+	}
+	// Augmenting changes the build, which may be needed again.
+	build, err := copyBuild(b)
+	if err != nil {
+		return fmt.Errorf("could not copy build: %v", err)
+	}
+	inputs := state.Inputs(name)
+	completed := map[string]bool{}
+	for _, p := range inputs.Params {
+		completed[p.Name] = true
+	}
+	AugmentBuild(build, ArtifactsPrefix(c.ProjectID, c.WorkflowID), c.WorkflowID, "", inputs, state.Options, attempt, completed)
+	buildID, err := c.Submit(ctx, build)
+	if err != nil {
+		return fmt.Errorf("could not create build: %v", err)
+	}
+	log.Printf("%q execution attempt %d is build %s", name, attempt, buildID)
+
+	// The build exists whether or not this is published, so apply it anyway
+	// so that it is not created again.
+	m := Message{
+		Started: name,
+		Build:   buildID,
+		Attempt: attempt,
+	}
+	if err := c.publish(ctx, topic, m); err != nil {
+		log.Printf("Could not publish start of %q: %v", name, err)
+	}
+	state.Apply(m)
+	watcher.Apply(m)
+	return nil
+}
+
+func copyBuild(b *v1cloudbuild.Build) (*v1cloudbuild.Build, error) {
+	jdata, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	var cp v1cloudbuild.Build
+	if err := json.Unmarshal(jdata, &cp); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+// publish sends a message to the workflow topic, and remembers it until it is
+// seen again.
+func (c *Coordinator) publish(ctx context.Context, topic string, m Message) error {
+	data, err := EncodeMessage(m)
+	if err != nil {
+		return fmt.Errorf("could not encode message: %v", err)
+	}
+	resp, err := c.PubSub.Projects.Topics.Publish(topic, &v1pubsub.PublishRequest{
+		Messages: []*v1pubsub.PubsubMessage{{
+			Data: data,
+		}},
+	}).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("could not publish to %q: %v", topic, err)
+	}
+	for _, id := range resp.MessageIds {
+		c.pending[id] = true
+	}
+	return nil
+}
+
+// handle records one message from the workflow topic, and returns it.
+func (c *Coordinator) handle(ctx context.Context, pm *v1pubsub.PubsubMessage) (Message, error) {
+	data, err := base64.StdEncoding.DecodeString(pm.Data)
+	if err != nil {
+		return Message{}, err
+	}
+	fmt.Fprintf(c.Log, "%s\n", data)
+
+	m, err := DecodeMessage(pm.Data)
+	if err != nil {
+		// Nobody else will be able to read it either.
+		log.Printf("Could not decode message %s: %v", pm.MessageId, err)
+		delete(c.pending, pm.MessageId)
+		return Message{}, nil
+	}
+	if err := RecordEvent(ctx, c.Storage, c.ProjectID, c.WorkflowID, pm.MessageId, pm.PublishTime, m); err != nil {
+		return Message{}, err
+	}
+	delete(c.pending, pm.MessageId)
+	return m, nil
+}
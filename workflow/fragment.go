@@ -0,0 +1,74 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package workflow
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	v1cloudbuild "google.golang.org/api/cloudbuild/v1"
+
+	"github.com/skelterjohn/flargo/config"
+	"github.com/skelterjohn/flargo/executions"
+)
+
+// FragmentFile is where, in its out directory, an execution may leave a config
+// fragment to add executions to the workflow. The build files it names are
+// found relative to it.
+const FragmentFile = "flargo.wf"
+
+// ReadFragment loads the config fragment that the named execution left in dir,
+// along with the builds it refers to. It returns nil if there is none. The
+// fragment is checked against the workflow as recorded so far, so that a bad
+// one fails the execution instead of being dropped later.
+func ReadFragment(ctx context.Context, sc *storage.Client, projectID, workflowID, name, dir string) (*config.Config, map[string]*v1cloudbuild.Build, error) {
+	path := filepath.Join(dir, FragmentFile)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	fragment, err := config.LoadFragment(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	builds := map[string]*v1cloudbuild.Build{}
+	for _, ce := range fragment.Executions {
+		if ce.Type != config.TypeExec {
+			continue
+		}
+		b, err := executions.LoadExecutionBuild(dir, ce)
+		if err != nil {
+			return nil, nil, err
+		}
+		builds[ce.Name] = b
+	}
+
+	state, err := LoadState(ctx, sc, projectID, workflowID)
+	if err == storage.ErrObjectNotExist {
+		// Without a manifest, there is nothing to check it against.
+		return fragment, builds, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if state.Config != nil {
+		cfg := *state.Config
+		if err := cfg.Extend(fragment, name); err != nil {
+			return nil, nil, fmt.Errorf("could not add %q to the workflow: %v", path, err)
+		}
+	}
+	return fragment, builds, nil
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	v1cloudbuild "google.golang.org/api/cloudbuild/v1"
+	"google.golang.org/api/iterator"
+
+	"github.com/skelterjohn/flargo/config"
+)
+
+/*
+Each workflow keeps a durable record of itself next to its artifacts, under
+gs://<project>_workflow_artifacts/<workflow ID>/_flargo. The manifest is written
+once by flargo start, and every message published on the workflow topic is
+added to the event log as its own object, by coord. Together they hold
+everything needed to rebuild the workflow's state.
+*/
+
+// A Manifest describes a workflow as it was started.
+type Manifest struct {
+	WorkflowID string         `json:"workflowID"`
+	Config     *config.Config `json:"config"`
+	Options    Options        `json:"options"`
+	// Builds has the build each exec execution runs, as loaded from its
+	// config and before flargo adds its own steps.
+	Builds    map[string]*v1cloudbuild.Build `json:"builds"`
+	StartedBy string                         `json:"startedBy,omitempty"`
+	StartTime string                         `json:"startTime"`
+}
+
+// RecordPrefix is where, in the artifacts bucket, a workflow's manifest and
+// event log are kept.
+func RecordPrefix(workflowID string) string {
+	return path.Join(workflowID, "_flargo")
+}
+
+func manifestObject(workflowID string) string {
+	return path.Join(RecordPrefix(workflowID), "manifest.json")
+}
+
+func eventsPrefix(workflowID string) string {
+	return path.Join(RecordPrefix(workflowID), "events") + "/"
+}
+
+// WriteManifest saves the workflow's manifest.
+func WriteManifest(ctx context.Context, sc *storage.Client, projectID string, m *Manifest) error {
+	return writeJSON(ctx, sc, ArtifactsBucket(projectID), manifestObject(m.WorkflowID), m)
+}
+
+// ReadManifest loads the workflow's manifest. It returns
+// storage.ErrObjectNotExist if the workflow does not have one.
+func ReadManifest(ctx context.Context, sc *storage.Client, projectID, workflowID string) (*Manifest, error) {
+	var m Manifest
+	if err := readJSON(ctx, sc, ArtifactsBucket(projectID), manifestObject(workflowID), &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// RecordEvent adds a message to the workflow's event log. The message's pubsub
+// ID and publish time name the event, so recording it again does nothing new
+// and the log lists events in about the order they were published.
+func RecordEvent(ctx context.Context, sc *storage.Client, projectID, workflowID, messageID, publishTime string, m Message) error {
+	t, err := time.Parse(time.RFC3339Nano, publishTime)
+	if err != nil {
+		return fmt.Errorf("could not parse publish time %q: %v", publishTime, err)
+	}
+	name := fmt.Sprintf("%s%s-%s.json", eventsPrefix(workflowID), t.UTC().Format("20060102T150405.000000000"), messageID)
+	return writeJSON(ctx, sc, ArtifactsBucket(projectID), name, m)
+}
+
+// ReadEvents loads the workflow's event log, in order.
+func ReadEvents(ctx context.Context, sc *storage.Client, projectID, workflowID string) ([]Message, error) {
+	bucket := ArtifactsBucket(projectID)
+	it := sc.Bucket(bucket).Objects(ctx, &storage.Query{
+		Prefix: eventsPrefix(workflowID),
+	})
+	var names []string
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not list events: %v", err)
+		}
+		names = append(names, attrs.Name)
+	}
+	sort.Strings(names)
+
+	var msgs []Message
+	for _, name := range names {
+		var m Message
+		if err := readJSON(ctx, sc, bucket, name, &m); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+// Recorded is true once the message with the pubsub ID is in the workflow's
+// event log.
+func Recorded(ctx context.Context, sc *storage.Client, projectID, workflowID, messageID string) (bool, error) {
+	it := sc.Bucket(ArtifactsBucket(projectID)).Objects(ctx, &storage.Query{
+		Prefix: eventsPrefix(workflowID),
+	})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("could not list events: %v", err)
+		}
+		if strings.HasSuffix(attrs.Name, "-"+messageID+".json") {
+			return true, nil
+		}
+	}
+}
+
+// LoadState rebuilds the workflow's state from its manifest and event log. It
+// returns storage.ErrObjectNotExist if the workflow does not have a manifest.
+func LoadState(ctx context.Context, sc *storage.Client, projectID, workflowID string) (*State, error) {
+	manifest, err := ReadManifest(ctx, sc, projectID, workflowID)
+	if err != nil {
+		return nil, err
+	}
+	events, err := ReadEvents(ctx, sc, projectID, workflowID)
+	if err != nil {
+		return nil, err
+	}
+	s := NewState()
+	s.Builds = manifest.Builds
+	s.Apply(Message{
+		Config:  manifest.Config,
+		Options: &manifest.Options,
+	})
+	for _, m := range events {
+		s.Apply(m)
+	}
+	return s, nil
+}
+
+func writeJSON(ctx context.Context, sc *storage.Client, bucket, object string, v interface{}) error {
+	jdata, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w := sc.Bucket(bucket).Object(object).NewWriter(ctx)
+	w.ContentType = "application/json"
+	if _, err := w.Write(jdata); err != nil {
+		w.Close()
+		return fmt.Errorf("could not write gs://%s/%s: %v", bucket, object, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("could not write gs://%s/%s: %v", bucket, object, err)
+	}
+	return nil
+}
+
+func readJSON(ctx context.Context, sc *storage.Client, bucket, object string, v interface{}) error {
+	r, err := sc.Bucket(bucket).Object(object).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("could not read gs://%s/%s: %v", bucket, object, err)
+	}
+	defer r.Close()
+	jdata, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("could not read gs://%s/%s: %v", bucket, object, err)
+	}
+	if err := json.Unmarshal(jdata, v); err != nil {
+		return fmt.Errorf("could not decode gs://%s/%s: %v", bucket, object, err)
+	}
+	return nil
+}
@@ -0,0 +1,483 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package workflow
+
+import (
+	"sort"
+	"time"
+
+	v1cloudbuild "google.golang.org/api/cloudbuild/v1"
+
+	"github.com/skelterjohn/flargo/config"
+)
+
+type Status string
+
+const (
+	// StatusPending means there is no build for the execution yet.
+	StatusPending Status = "pending"
+	// StatusWaiting means the build is waiting for its dependencies.
+	StatusWaiting Status = "waiting"
+	// StatusRunning means the build is past its wait step.
+	StatusRunning Status = "running"
+	// StatusAwaitingApproval means a wait execution is ready to be approved.
+	StatusAwaitingApproval Status = "awaiting approval"
+	StatusSucceeded        Status = "succeeded"
+	StatusFailed           Status = "failed"
+	StatusSkipped          Status = "skipped"
+	// StatusRetrying means the latest attempt failed, and coord will start
+	// another once its backoff has passed.
+	StatusRetrying Status = "retrying"
+	// StatusBlocked means something the execution depends on, directly or
+	// not, has failed, so it cannot go ahead unless that is retried or skipped.
+	StatusBlocked Status = "blocked"
+)
+
+// Terminal is true if an execution with this status will not change again
+// without someone retrying or skipping it.
+func (s Status) Terminal() bool {
+	return s == StatusSucceeded || s == StatusFailed || s == StatusSkipped
+}
+
+// Done is true if dependents of an execution with this status may run.
+func (s Status) Done() bool {
+	return s == StatusSucceeded || s == StatusSkipped
+}
+
+// An Attempt is one build created for an execution.
+type Attempt struct {
+	Number int    `json:"number"`
+	Build  string `json:"build"`
+	// Reason says how the attempt ended, if it failed.
+	Reason string `json:"reason,omitempty"`
+}
+
+type Execution struct {
+	config.Execution
+	// Build is the build for the latest attempt.
+	Build     string
+	Status    Status
+	Artifacts string
+	Manifest  []Artifact
+	Attempts  []Attempt
+	Approval  *Approval
+	// Reason says how the build ended, if it failed.
+	Reason string
+	// RetryAt is when coord will retry the execution, if it is retrying.
+	RetryAt string
+	// Unblocked is set once coord has announced that everything the
+	// execution depends on is done.
+	Unblocked bool
+	// EmittedBy is the execution whose config fragment added this one to the
+	// workflow, if any. Emitted lists the executions this one added, and
+	// EmitError says why its fragment could not be added.
+	EmittedBy string
+	Emitted   []string
+	EmitError string
+}
+
+// endAttempt records how the numbered attempt ended.
+func (e *Execution) endAttempt(number int, reason string) {
+	for i := range e.Attempts {
+		if e.Attempts[i].Number == number {
+			e.Attempts[i].Reason = reason
+		}
+	}
+}
+
+// Attempt is the number of the latest attempt, or 0 if there has been none.
+func (e *Execution) Attempt() int {
+	if len(e.Attempts) == 0 {
+		return 0
+	}
+	return e.Attempts[len(e.Attempts)-1].Number
+}
+
+// State is a view of a workflow built up from the messages on its topic.
+// Applying the same message more than once has no further effect, so messages
+// may come from both the event log and a subscription.
+type State struct {
+	Config  *config.Config
+	Options Options
+	// Builds has the build of each exec execution, if the workflow has a
+	// manifest.
+	Builds     map[string]*v1cloudbuild.Build
+	Executions map[string]*Execution
+	// Result is the outcome coord last announced for the workflow. It is
+	// cleared when a new attempt starts, since the workflow is going again,
+	// unless the workflow timed out or was cancelled.
+	Result    Status
+	TimedOut  bool
+	Cancelled bool
+}
+
+func NewState() *State {
+	return &State{
+		Executions: map[string]*Execution{},
+	}
+}
+
+func (s *State) execution(name string) *Execution {
+	e, ok := s.Executions[name]
+	if !ok {
+		e = &Execution{
+			Status: StatusPending,
+		}
+		e.Name = name
+		s.Executions[name] = e
+	}
+	return e
+}
+
+func (s *State) Apply(m Message) {
+	if m.Config != nil {
+		s.Config = m.Config
+		if m.Options != nil {
+			s.Options = *m.Options
+		}
+		for _, ce := range m.Config.Executions {
+			s.execution(ce.Name).Execution = ce
+		}
+	}
+	if m.Started != "" {
+		e := s.execution(m.Started)
+		attempt := m.Attempt
+		if attempt == 0 {
+			attempt = 1
+		}
+		// Attempts may be seen out of order, or more than once.
+		i := sort.Search(len(e.Attempts), func(i int) bool {
+			return e.Attempts[i].Number >= attempt
+		})
+		if i == len(e.Attempts) || e.Attempts[i].Number != attempt {
+			e.Attempts = append(e.Attempts, Attempt{})
+			copy(e.Attempts[i+1:], e.Attempts[i:])
+			e.Attempts[i] = Attempt{
+				Number: attempt,
+				Build:  m.Build,
+			}
+			// A quick build may complete before its start is seen.
+			if i == len(e.Attempts)-1 {
+				e.Build = m.Build
+			}
+			if i == len(e.Attempts)-1 && !e.Status.Done() {
+				e.Status = StatusRunning
+				e.Reason = ""
+				e.RetryAt = ""
+				if !s.Stopped() {
+					s.Result = ""
+				}
+			}
+		}
+	}
+	if m.Failed != "" {
+		e := s.execution(m.Failed)
+		e.endAttempt(m.Attempt, m.Reason)
+		// The failure of an earlier attempt says nothing about a retry.
+		if !e.Status.Done() && (m.Attempt == 0 || m.Attempt >= e.Attempt()) {
+			e.Status = StatusFailed
+			e.Reason = m.Reason
+		}
+	}
+	if m.Retrying != "" {
+		e := s.execution(m.Retrying)
+		e.endAttempt(m.Attempt, m.Reason)
+		if !e.Status.Done() && m.Attempt >= e.Attempt() {
+			e.Status = StatusRetrying
+			e.Reason = m.Reason
+			e.RetryAt = m.RetryAt
+		}
+	}
+	if m.Completed != "" {
+		e := s.execution(m.Completed)
+		e.Status = StatusSucceeded
+		if m.Skipped {
+			e.Status = StatusSkipped
+		}
+		e.Artifacts = m.Artifacts
+		e.Manifest = m.Manifest
+		if m.Approval != nil {
+			e.Approval = m.Approval
+		}
+		if m.Emitted != nil && len(e.Emitted) == 0 && e.EmitError == "" {
+			s.extend(e, m.Emitted, m.EmittedBuilds)
+		}
+	}
+	if m.Unblocked != "" {
+		s.execution(m.Unblocked).Unblocked = true
+	}
+	if m.Result != "" {
+		s.Result = m.Result
+		switch m.Reason {
+		case ReasonTimeout:
+			s.TimedOut = true
+		case ReasonCancelled:
+			s.Cancelled = true
+		}
+	}
+}
+
+// extend adds the executions in a fragment emitted by e to the workflow.
+func (s *State) extend(e *Execution, fragment *config.Config, builds map[string]*v1cloudbuild.Build) {
+	if s.Config == nil {
+		e.EmitError = "workflow config not found"
+		return
+	}
+	// The config may be shared with whoever applied it.
+	cfg := *s.Config
+	if err := cfg.Extend(fragment, e.Name); err != nil {
+		e.EmitError = err.Error()
+		return
+	}
+	s.Config = &cfg
+	if s.Builds == nil {
+		s.Builds = map[string]*v1cloudbuild.Build{}
+	}
+	for _, ce := range cfg.Executions[len(cfg.Executions)-len(fragment.Executions):] {
+		ee := s.execution(ce.Name)
+		ee.Execution = ce
+		ee.EmittedBy = e.Name
+		e.Emitted = append(e.Emitted, ce.Name)
+		if b, ok := builds[ce.Name]; ok {
+			s.Builds[ce.Name] = b
+		}
+	}
+}
+
+// SetStatus records a status learned from somewhere other than the topic, such
+// as the cloudbuild status of an execution's build.
+func (s *State) SetStatus(name string, status Status) {
+	s.execution(name).Status = status
+}
+
+// Ready is true if everything the named execution depends on is done. The
+// dependency that a condition checks the outcome of only has to have finished,
+// whether or not it succeeded.
+func (s *State) Ready(name string) bool {
+	e, ok := s.Executions[name]
+	if !ok {
+		return false
+	}
+	for _, p := range e.Params {
+		dep, ok := s.Executions[p.Name]
+		if !ok {
+			return false
+		}
+		if checks(e, p.Name) && (dep.Status == StatusFailed || s.Blocked(p.Name)) {
+			continue
+		}
+		if !dep.Status.Done() {
+			return false
+		}
+	}
+	return true
+}
+
+// Blocked is true if the named execution can never run because something it
+// depends on, directly or not, has failed. A failure whose outcome a condition
+// checks does not block it.
+func (s *State) Blocked(name string) bool {
+	return len(s.BlockedBy(name)) != 0
+}
+
+// BlockedBy lists the named execution's dependencies that have failed or are
+// blocked themselves.
+func (s *State) BlockedBy(name string) []string {
+	var names []string
+	e, ok := s.Executions[name]
+	if !ok {
+		return names
+	}
+	for _, p := range e.Params {
+		dep, ok := s.Executions[p.Name]
+		if !ok || checks(e, p.Name) {
+			continue
+		}
+		if dep.Status == StatusFailed || s.Blocked(p.Name) {
+			names = append(names, p.Name)
+		}
+	}
+	return names
+}
+
+// checks is true if e's condition is on the outcome of the named dependency.
+func checks(e *Execution, name string) bool {
+	return e.When != nil && e.When.Outcome != "" && e.When.Execution == name
+}
+
+// Retry returns the message announcing that the named execution will be
+// retried, if its build failed on the given attempt and it has retries left.
+// An execution whose dependencies are not all done is not retried, since that
+// is likely why its build failed.
+func (s *State) Retry(name string, attempt int, build, reason string) (Message, bool) {
+	e, ok := s.Executions[name]
+	if !ok || !s.Ready(name) {
+		return Message{}, false
+	}
+	delay, ok := e.RetryDelay(attempt)
+	if !ok {
+		return Message{}, false
+	}
+	return Message{
+		Retrying: name,
+		Build:    build,
+		Attempt:  attempt,
+		Reason:   reason,
+		RetryAt:  time.Now().Add(delay).UTC().Format(time.RFC3339),
+	}, true
+}
+
+// Current is true if the numbered attempt is the named execution's latest, and
+// is still running in a workflow that has not been stopped.
+func (s *State) Current(name string, attempt int) bool {
+	e, ok := s.Executions[name]
+	return ok && !s.Stopped() && e.Status == StatusRunning && e.Attempt() == attempt
+}
+
+// Holds is true if the named execution has no condition, or if its condition
+// holds. It only makes sense once the execution is Ready.
+func (s *State) Holds(name string) bool {
+	e, ok := s.Executions[name]
+	if !ok || e.When == nil {
+		return ok
+	}
+	switch e.When.Outcome {
+	case config.OutcomeSuccess:
+		return s.Executions[e.When.Execution].Status.Done()
+	case config.OutcomeFailure:
+		return !s.Executions[e.When.Execution].Status.Done()
+	}
+	return e.When.Compare(s.Options.Params[e.When.Param])
+}
+
+// Inputs is the named execution's config, as its build should be created once
+// it is Ready. Only a dependency that a condition checks can have failed, and
+// that one has no artifacts to wait for, so it is left out.
+func (s *State) Inputs(name string) config.Execution {
+	e := s.Executions[name]
+	ce := e.Execution
+	if e.When == nil || e.When.Outcome == "" || s.Executions[e.When.Execution].Status.Done() {
+		return ce
+	}
+	ce.Params = nil
+	for _, p := range e.Params {
+		if p.Name != e.When.Execution {
+			ce.Params = append(ce.Params, p)
+		}
+	}
+	return ce
+}
+
+// Status is the execution's status, or StatusBlocked if it has not finished
+// and cannot until a failure upstream of it is dealt with.
+func (s *State) Status(name string) Status {
+	e, ok := s.Executions[name]
+	if !ok {
+		return StatusPending
+	}
+	if !e.Status.Done() && s.Blocked(name) {
+		return StatusBlocked
+	}
+	return e.Status
+}
+
+// Finished is true once every execution in the config has succeeded, failed,
+// or is blocked by a failure.
+func (s *State) Finished() bool {
+	if s.Config == nil {
+		return false
+	}
+	for _, ce := range s.Config.Executions {
+		if !s.Executions[ce.Name].Status.Terminal() && !s.Blocked(ce.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// Failed lists the executions in the config that have failed, other than those
+// that were blocked by an earlier failure.
+func (s *State) Failed() []string {
+	var names []string
+	if s.Config == nil {
+		return names
+	}
+	for _, ce := range s.Config.Executions {
+		if s.Status(ce.Name) == StatusFailed {
+			names = append(names, ce.Name)
+		}
+	}
+	return names
+}
+
+// Outcome is StatusSucceeded once every execution is done, StatusFailed once
+// the workflow has finished with failures, and empty until it has finished.
+func (s *State) Outcome() Status {
+	if !s.Finished() {
+		return ""
+	}
+	if len(s.Failed()) != 0 {
+		return StatusFailed
+	}
+	return StatusSucceeded
+}
+
+// Over is true once coord has announced a result that ends the workflow: it
+// succeeded, it was stopped, or it failed under UpstreamFailureFail. A workflow
+// that failed under UpstreamFailurePark can still be retried or skipped, so it
+// is never over, and is only done with once its coord build ends.
+func (s *State) Over() bool {
+	switch s.Result {
+	case StatusSucceeded:
+		return true
+	case StatusFailed:
+		return s.Stopped() || s.Options.UpstreamFailure == UpstreamFailureFail
+	}
+	return false
+}
+
+// Stopped is true if the workflow timed out or was cancelled, which fails it
+// whatever becomes of its executions.
+func (s *State) Stopped() bool {
+	return s.TimedOut || s.Cancelled
+}
+
+// Derive returns the messages that follow from the state but have not been
+// applied to it: one for each execution that is newly unblocked, a skip for
+// each one whose condition turned out not to hold, and one for the workflow's
+// outcome if that has changed, unless the workflow was stopped. Every execution
+// is unblocked once everything it depends on is done, even if it has already
+// finished by the time coord notices.
+func (s *State) Derive() []Message {
+	var msgs []Message
+	if s.Config == nil {
+		return msgs
+	}
+	for _, ce := range s.Config.Executions {
+		e := s.Executions[ce.Name]
+		if !e.Unblocked && s.Ready(ce.Name) {
+			msgs = append(msgs, Message{Unblocked: ce.Name})
+		}
+		if ce.When != nil && e.Attempt() == 0 && !e.Status.Terminal() && s.Ready(ce.Name) && !s.Holds(ce.Name) {
+			msgs = append(msgs, Message{
+				Completed: ce.Name,
+				Status:    StatusSkipped,
+				Skipped:   true,
+			})
+		}
+	}
+	if o := s.Outcome(); o != "" && o != s.Result && !s.Stopped() {
+		msgs = append(msgs, Message{Result: o})
+	}
+	return msgs
+}
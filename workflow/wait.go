@@ -0,0 +1,164 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package workflow
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	v1pubsub "google.golang.org/api/pubsub/v1"
+)
+
+// WaitUsage describes the arguments of the wait step.
+const WaitUsage = "wait [--completed=EXECUTION:ALIAS,...] [--upstream-failure=park|fail] GCS_PREFIX WORKFLOW_ID SUBSCRIPTION (BLOCKING_EXECUTION:ALIAS)*"
+
+// A Waiter does the work of the wait step, which begins every execution's
+// build. It blocks until each of the execution's dependencies has completed,
+// and fetches their artifacts into Artifacts/in under their aliases.
+type Waiter struct {
+	PubSub  *v1pubsub.Service
+	Storage *storage.Client
+	// Artifacts is where the build keeps its artifacts, /workflow_artifacts
+	// outside of tests.
+	Artifacts string
+
+	gcsPrefix    string
+	subscription string
+	// completed maps each dependency that has already completed to its
+	// alias, and blocks each one still to be waited for.
+	completed       map[string]string
+	blocks          map[string]string
+	upstreamFailure UpstreamFailure
+}
+
+// ParseWaiter reads the wait step's arguments, as AugmentBuild writes them.
+func ParseWaiter(args []string) (*Waiter, error) {
+	fs := flag.NewFlagSet("wait", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	completed := fs.String("completed", "", "comma separated EXECUTION:ALIAS pairs that have already completed")
+	upstreamFailure := fs.String("upstream-failure", "park", "what to do when a blocking execution fails, park or fail")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() < 3 {
+		return nil, errors.New("missing arguments")
+	}
+	policy, err := ParseUpstreamFailure(*upstreamFailure)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(fs.Arg(0), "gs://") || !strings.Contains(strings.TrimPrefix(fs.Arg(0), "gs://"), "/") {
+		return nil, fmt.Errorf("invalid GCS prefix %q", fs.Arg(0))
+	}
+	w := &Waiter{
+		gcsPrefix:       fs.Arg(0),
+		subscription:    fs.Arg(2),
+		completed:       map[string]string{},
+		blocks:          map[string]string{},
+		upstreamFailure: policy,
+	}
+	if *completed != "" {
+		for _, dep := range strings.Split(*completed, ",") {
+			name, alias := splitDependency(dep)
+			w.completed[name] = alias
+		}
+	}
+	for _, dep := range fs.Args()[3:] {
+		name, alias := splitDependency(dep)
+		w.blocks[name] = alias
+	}
+	return w, nil
+}
+
+// splitDependency reads an EXECUTION:ALIAS pair.
+func splitDependency(dep string) (string, string) {
+	tokens := strings.SplitN(dep, ":", 2)
+	if len(tokens) != 2 {
+		return dep, dep
+	}
+	return tokens[0], tokens[1]
+}
+
+// Run waits for the blocking executions, and then makes the out directory for
+// the execution's own artifacts. Under UpstreamFailureFail, it returns an
+// error as soon as one of them fails.
+func (w *Waiter) Run(ctx context.Context) error {
+	// A retried execution may depend on things that completed before its
+	// subscription existed, so their completions will never arrive.
+	for name, alias := range w.completed {
+		if err := w.fetch(ctx, name, alias); err != nil {
+			return err
+		}
+	}
+
+	// Poll the subscription until the blocks are resolved.
+	for len(w.blocks) > 0 {
+		resp, err := w.PubSub.Projects.Subscriptions.Pull(w.subscription, &v1pubsub.PullRequest{
+			MaxMessages: 10,
+		}).Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("could not pull from subscription: %v", err)
+		}
+		for _, rmsg := range resp.ReceivedMessages {
+			if _, err := w.PubSub.Projects.Subscriptions.Acknowledge(w.subscription, &v1pubsub.AcknowledgeRequest{
+				AckIds: []string{rmsg.AckId},
+			}).Context(ctx).Do(); err != nil {
+				log.Printf("Could not ack %q: %v", rmsg.AckId, err)
+			}
+
+			m, err := DecodeMessage(rmsg.Message.Data)
+			if err != nil {
+				log.Printf("Could not decode message: %v", err)
+				continue
+			}
+			if _, ok := w.blocks[m.Failed]; m.Failed != "" && ok {
+				if w.upstreamFailure == UpstreamFailureFail {
+					return fmt.Errorf("upstream %q failed: attempt %d ended with %s", m.Failed, m.Attempt, m.Reason)
+				}
+				log.Printf("Upstream %q failed: attempt %d ended with %s. Waiting for it to be retried or skipped.", m.Failed, m.Attempt, m.Reason)
+			}
+			if alias, ok := w.blocks[m.Completed]; m.Completed != "" && ok {
+				log.Printf("Got completion of %q attempt %d (%s)", m.Completed, m.Attempt, m.Status)
+				delete(w.blocks, m.Completed)
+				// copy the blocking execution's artifacts into this execution.
+				if err := w.fetch(ctx, m.Completed, alias); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(w.Artifacts, "out"), 0755); err != nil {
+		return fmt.Errorf("could not make artifact out directory: %v", err)
+	}
+	return nil
+}
+
+// fetch copies the named execution's artifacts to in/alias.
+func (w *Waiter) fetch(ctx context.Context, name, alias string) error {
+	tokens := strings.SplitN(strings.TrimPrefix(w.gcsPrefix, "gs://"), "/", 2)
+	bucket, object := tokens[0], tokens[1]
+	if err := DownloadArtifacts(ctx, w.Storage, bucket, path.Join(object, name), filepath.Join(w.Artifacts, "in", alias)); err != nil {
+		return fmt.Errorf("could not fetch artifacts for %q: %v", name, err)
+	}
+	return nil
+}
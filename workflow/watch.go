@@ -0,0 +1,111 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package workflow
+
+import (
+	"fmt"
+	"sort"
+
+	"golang.org/x/net/context"
+)
+
+// A Watcher keeps an eye on the builds of running executions. A build that
+// fails never gets to its complete step, so without someone watching, nothing
+// would tell its dependents.
+type Watcher struct {
+	// builds has the latest attempt of each execution that has not finished.
+	builds map[string]Attempt
+	// cancelled has the builds that have been seen cancelled once.
+	cancelled map[string]bool
+}
+
+func NewWatcher() *Watcher {
+	return &Watcher{
+		builds:    map[string]Attempt{},
+		cancelled: map[string]bool{},
+	}
+}
+
+// Apply starts or stops watching builds according to a message from the
+// workflow topic.
+func (w *Watcher) Apply(m Message) {
+	if m.Started != "" {
+		attempt := m.Attempt
+		if attempt == 0 {
+			attempt = 1
+		}
+		if a, ok := w.builds[m.Started]; !ok || a.Number <= attempt {
+			w.builds[m.Started] = Attempt{
+				Number: attempt,
+				Build:  m.Build,
+			}
+		}
+	}
+	if m.Completed != "" {
+		delete(w.builds, m.Completed)
+	}
+	for _, name := range []string{m.Failed, m.Retrying} {
+		if a, ok := w.builds[name]; ok && name != "" && a.Number <= m.Attempt {
+			delete(w.builds, name)
+		}
+	}
+}
+
+// Idle is true if there are no builds being watched.
+func (w *Watcher) Idle() bool {
+	return len(w.builds) == 0
+}
+
+// Check gets the cloudbuild status of each build being watched, and returns a
+// failure message for each one that has failed. A cancelled build fails with
+// ReasonCancelled, but only once it is still being watched on the next check.
+// flargo announces a retry or skip before cancelling the build it replaces, so
+// by then the announcement has been applied and the build is no longer
+// watched.
+func (w *Watcher) Check(ctx context.Context, buildStatus func(ctx context.Context, buildID string) (string, error)) ([]Message, error) {
+	var names []string
+	for name := range w.builds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var failures []Message
+	for _, name := range names {
+		a := w.builds[name]
+		status, err := buildStatus(ctx, a.Build)
+		if err != nil {
+			return failures, fmt.Errorf("could not get status of %q build %s: %v", name, a.Build, err)
+		}
+		switch status {
+		case "SUCCESS":
+			delete(w.builds, name)
+		case "CANCELLED":
+			if !w.cancelled[a.Build] {
+				w.cancelled[a.Build] = true
+				continue
+			}
+			delete(w.cancelled, a.Build)
+			fallthrough
+		case "FAILURE", "INTERNAL_ERROR", "TIMEOUT":
+			delete(w.builds, name)
+			failures = append(failures, Message{
+				Failed:  name,
+				Status:  StatusFailed,
+				Reason:  status,
+				Build:   a.Build,
+				Attempt: a.Number,
+			})
+		}
+	}
+	return failures, nil
+}
@@ -0,0 +1,298 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package workflow
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	v1cloudbuild "google.golang.org/api/cloudbuild/v1"
+	v1pubsub "google.golang.org/api/pubsub/v1"
+
+	"github.com/skelterjohn/flargo/config"
+)
+
+/*
+The workflow package holds what the flargo tool and the coord, wait and complete
+steps need to agree on: resource names and the messages sent on a workflow's topic.
+*/
+
+// MessageVersion is the version of the message format that this package reads
+// and writes. Messages without a version were written before it had one.
+const MessageVersion = 1
+
+// A Message is published on the workflow topic whenever something happens to
+// the workflow. Only the fields relevant to that event are set.
+type Message struct {
+	Version int `json:"version,omitempty"`
+
+	// Config is published once, by flargo start, along with the Options it
+	// was started with.
+	Config  *config.Config `json:"config,omitempty"`
+	Options *Options       `json:"options,omitempty"`
+
+	// Started is the name of an execution whose build was just created, and
+	// Build is that build's ID. Attempt counts from 1, and goes up each time
+	// the execution is retried.
+	Started string `json:"started,omitempty"`
+	Build   string `json:"build,omitempty"`
+	Attempt int    `json:"attempt,omitempty"`
+
+	// Completed is the name of an execution that finished successfully, or
+	// that someone decided to go on without if Skipped is set. Coord also
+	// skips executions whose condition does not hold. When the
+	// complete step sends it, Build and Attempt say which attempt it was, and
+	// Manifest lists the artifacts it uploaded to Artifacts.
+	Completed string     `json:"completed,omitempty"`
+	Status    Status     `json:"status,omitempty"`
+	Skipped   bool       `json:"skipped,omitempty"`
+	Artifacts string     `json:"artifacts,omitempty"`
+	Manifest  []Artifact `json:"manifest,omitempty"`
+
+	// Emitted is a config fragment that Completed left in its out directory,
+	// and EmittedBuilds has the builds its exec executions run. Its
+	// executions are added to the workflow, each depending on Completed.
+	Emitted       *config.Config                 `json:"emitted,omitempty"`
+	EmittedBuilds map[string]*v1cloudbuild.Build `json:"emittedBuilds,omitempty"`
+
+	// Approval is set when Completed is a wait execution that someone approved.
+	Approval *Approval `json:"approval,omitempty"`
+
+	// Failed is the name of an execution whose build did not succeed, and
+	// Reason says how it ended. Build and Attempt say which attempt it was.
+	// Along with Result, Reason is ReasonTimeout if the workflow ran out of
+	// time, and ReasonCancelled if someone cancelled it.
+	Failed string `json:"failed,omitempty"`
+	Reason string `json:"reason,omitempty"`
+
+	// Retrying is the name of an execution whose build failed, and that coord
+	// will retry at RetryAt, an RFC3339 time, instead of failing it. Build,
+	// Attempt and Reason say which attempt failed and how.
+	Retrying string `json:"retrying,omitempty"`
+	RetryAt  string `json:"retryAt,omitempty"`
+
+	// Unblocked is the name of an execution whose dependencies are all done,
+	// and Result is the outcome of the whole workflow. Coord derives both
+	// from the other messages.
+	Unblocked string `json:"unblocked,omitempty"`
+	Result    Status `json:"result,omitempty"`
+}
+
+// Options are the choices made when a workflow is started, rather than in its
+// config.
+type Options struct {
+	// UpstreamFailure says what an execution does when something it waits for
+	// fails.
+	UpstreamFailure UpstreamFailure `json:"upstreamFailure,omitempty"`
+	// Scheduling says when the builds of executions are created.
+	Scheduling Scheduling `json:"scheduling,omitempty"`
+	// Params has the value of each of the config's params.
+	Params map[string]string `json:"params,omitempty"`
+	// Timeout, if set, is how long the workflow may run before coord cancels
+	// whatever is left of it. BootstrapTimeout is how long flargo start waits
+	// for coord to be running.
+	Timeout          time.Duration `json:"timeout,omitempty"`
+	BootstrapTimeout time.Duration `json:"bootstrapTimeout,omitempty"`
+}
+
+// DefaultBootstrapTimeout is how long flargo start waits for coord, unless it
+// is told otherwise.
+const DefaultBootstrapTimeout = 10 * time.Minute
+
+// ReasonTimeout is the reason an execution or workflow fails when it runs out
+// of time, which is also the status of a build that cloudbuild timed out.
+const ReasonTimeout = "TIMEOUT"
+
+// ReasonCancelled is the reason a workflow fails when flargo cancel stops it.
+const ReasonCancelled = "CANCELLED"
+
+// An UpstreamFailure is a policy for executions whose dependencies fail.
+type UpstreamFailure string
+
+const (
+	// UpstreamFailurePark keeps the execution waiting until the failed
+	// dependency is retried or skipped.
+	UpstreamFailurePark UpstreamFailure = "park"
+	// UpstreamFailureFail fails the execution's build right away, which in
+	// turn fails whatever depends on it.
+	UpstreamFailureFail UpstreamFailure = "fail"
+)
+
+// ParseUpstreamFailure reads a policy from a flag. Empty means park.
+func ParseUpstreamFailure(s string) (UpstreamFailure, error) {
+	switch UpstreamFailure(s) {
+	case "", UpstreamFailurePark:
+		return UpstreamFailurePark, nil
+	case UpstreamFailureFail:
+		return UpstreamFailureFail, nil
+	}
+	return "", fmt.Errorf("unknown upstream failure policy %q, want %q or %q", s, UpstreamFailurePark, UpstreamFailureFail)
+}
+
+// A Scheduling is a choice of when to create the build of each execution.
+type Scheduling string
+
+const (
+	// SchedulingEager has flargo start create every build right away, and
+	// each build's wait step blocks until its dependencies complete.
+	SchedulingEager Scheduling = "eager"
+	// SchedulingLazy has coord create each build once its dependencies have
+	// completed, so its wait step only fetches their artifacts.
+	SchedulingLazy Scheduling = "lazy"
+)
+
+// ParseScheduling reads a scheduling mode from a flag. Empty means eager.
+func ParseScheduling(s string) (Scheduling, error) {
+	switch Scheduling(s) {
+	case "", SchedulingEager:
+		return SchedulingEager, nil
+	case SchedulingLazy:
+		return SchedulingLazy, nil
+	}
+	return "", fmt.Errorf("unknown scheduling %q, want %q or %q", s, SchedulingEager, SchedulingLazy)
+}
+
+// An Approval records who let a wait execution complete.
+type Approval struct {
+	By      string `json:"by"`
+	At      string `json:"at"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// An Artifact is one file that an execution left in its out directory.
+type Artifact struct {
+	// Path is relative to the out directory, with forward slashes.
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// MD5 is the hex encoded MD5 hash of the file.
+	MD5 string `json:"md5"`
+}
+
+// TopicName is the full name of the workflow's pubsub topic.
+func TopicName(projectID, workflowID string) string {
+	return fmt.Sprintf("projects/%s/topics/workflow-%s", projectID, workflowID)
+}
+
+// SubscriptionName is the full name of a subscription to the workflow's topic.
+func SubscriptionName(projectID, name string) string {
+	return fmt.Sprintf("projects/%s/subscriptions/%s", projectID, name)
+}
+
+// WorkflowTag is the cloudbuild tag of every coord build, so that workflows can
+// be listed.
+const WorkflowTag = "flargo-workflow"
+
+// ExecutionTags are the cloudbuild tags of an execution's builds, which say
+// what workflow and execution they belong to.
+func ExecutionTags(workflowID, name string) []string {
+	return []string{
+		tag("flargo-workflow-" + workflowID),
+		tag("flargo-exec-" + name),
+	}
+}
+
+// tag replaces whatever cloudbuild does not allow in a tag with '_', and
+// shortens it to the longest tag allowed.
+func tag(s string) string {
+	t := []byte(s)
+	for i, c := range t {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '.', c == '_':
+		default:
+			t[i] = '_'
+		}
+	}
+	if len(t) > 128 {
+		t = t[:128]
+	}
+	return string(t)
+}
+
+// WaitSubscriptionPrefix begins the name of each subscription that flargo wait
+// makes to the workflow's topic.
+func WaitSubscriptionPrefix(workflowID string) string {
+	return fmt.Sprintf("workflow-%s-wait-", workflowID)
+}
+
+// ArtifactsBucket is the GCS bucket that holds artifacts for all of a project's workflows.
+func ArtifactsBucket(projectID string) string {
+	return fmt.Sprintf("%s_workflow_artifacts", projectID)
+}
+
+// ArtifactsPrefix is the GCS location of a workflow's artifacts.
+func ArtifactsPrefix(projectID, workflowID string) string {
+	return fmt.Sprintf("gs://%s/%s", ArtifactsBucket(projectID), workflowID)
+}
+
+// EncodeMessage turns a message into pubsub message data, stamped with the
+// current version.
+func EncodeMessage(m Message) (string, error) {
+	m.Version = MessageVersion
+	jdata, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(jdata), nil
+}
+
+// DecodeMessage reads a message from pubsub message data.
+func DecodeMessage(data string) (Message, error) {
+	var m Message
+	dec := json.NewDecoder(base64.NewDecoder(base64.StdEncoding, strings.NewReader(data)))
+	if err := dec.Decode(&m); err != nil {
+		return m, err
+	}
+	if m.Version > MessageVersion {
+		return m, fmt.Errorf("message version %d is newer than %d", m.Version, MessageVersion)
+	}
+	return m, nil
+}
+
+// Publish sends a message on the given topic.
+func Publish(ctx context.Context, ps *v1pubsub.Service, topic string, m Message) error {
+	data, err := EncodeMessage(m)
+	if err != nil {
+		return fmt.Errorf("could not encode message: %v", err)
+	}
+	if _, err := ps.Projects.Topics.Publish(topic, &v1pubsub.PublishRequest{
+		Messages: []*v1pubsub.PubsubMessage{{
+			Data: data,
+		}},
+	}).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("could not publish to %q: %v", topic, err)
+	}
+	return nil
+}
+
+// ParseLog finds the messages that the coord step printed in its build log.
+// Lines that do not hold a message are ignored.
+func ParseLog(log string) []Message {
+	var msgs []Message
+	for _, line := range strings.Split(log, "\n") {
+		// Each line is prefixed by cloudbuild with the step that printed it.
+		i := strings.Index(line, "{")
+		if i == -1 {
+			continue
+		}
+		var m Message
+		if err := json.Unmarshal([]byte(line[i:]), &m); err != nil {
+			continue
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
@@ -0,0 +1,226 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package workflow
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	v1cloudbuild "google.golang.org/api/cloudbuild/v1"
+
+	"github.com/skelterjohn/flargo/config"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	m := Message{
+		Completed: "build",
+		Status:    StatusSucceeded,
+		Artifacts: "gs://p_workflow_artifacts/w/build",
+		Manifest: []Artifact{{
+			Path: "bin/service",
+			Size: 12,
+			MD5:  "d41d8cd98f00b204e9800998ecf8427e",
+		}},
+		Build:   "b1",
+		Attempt: 2,
+	}
+	data, err := EncodeMessage(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Version = MessageVersion
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("got %+v, want %+v", got, m)
+	}
+}
+
+func TestDecodeMessageVersion(t *testing.T) {
+	for _, tc := range []struct {
+		json string
+		ok   bool
+	}{
+		{`{"completed":"build"}`, true},
+		{`{"version":1,"completed":"build"}`, true},
+		{`{"version":2,"completed":"build"}`, false},
+	} {
+		_, err := DecodeMessage(base64.StdEncoding.EncodeToString([]byte(tc.json)))
+		if ok := err == nil; ok != tc.ok {
+			t.Errorf("%s: got error %v", tc.json, err)
+		}
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	statuses := map[string]string{
+		"b1": "FAILURE",
+		"b2": "CANCELLED",
+		"b3": "WORKING",
+		"b4": "TIMEOUT",
+		"b5": "CANCELLED",
+		"b6": "CANCELLED",
+		"b7": "WORKING",
+	}
+	buildStatus := func(ctx context.Context, buildID string) (string, error) {
+		return statuses[buildID], nil
+	}
+
+	w := NewWatcher()
+	for _, m := range []Message{
+		{Started: "build", Build: "b1", Attempt: 1},
+		{Started: "test", Build: "b2", Attempt: 1},
+		{Started: "test", Build: "b3", Attempt: 2},
+		{Started: "deploy", Build: "b4", Attempt: 1},
+		{Completed: "deploy"},
+		{Started: "lint", Build: "b5", Attempt: 1},
+		{Started: "package", Build: "b6", Attempt: 1},
+	} {
+		w.Apply(m)
+	}
+	failures, err := w.Check(context.Background(), buildStatus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Message{{
+		Failed:  "build",
+		Status:  StatusFailed,
+		Reason:  "FAILURE",
+		Build:   "b1",
+		Attempt: 1,
+	}}
+	if !reflect.DeepEqual(failures, want) {
+		t.Errorf("got %+v, want %+v", failures, want)
+	}
+
+	// A cancelled build is reported on the next check, unless it was
+	// replaced in the meantime, as flargo retry does. Each failure is only
+	// reported once.
+	w.Apply(Message{Started: "package", Build: "b7", Attempt: 2})
+	failures, err = w.Check(context.Background(), buildStatus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []Message{{
+		Failed:  "lint",
+		Status:  StatusFailed,
+		Reason:  ReasonCancelled,
+		Build:   "b5",
+		Attempt: 1,
+	}}
+	if !reflect.DeepEqual(failures, want) {
+		t.Errorf("got %+v, want %+v", failures, want)
+	}
+	failures, err = w.Check(context.Background(), buildStatus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failures) != 0 {
+		t.Errorf("got %+v again", failures)
+	}
+}
+
+func TestAugmentTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		params    []config.Param
+		opts      Options
+		completed map[string]bool
+		want      string
+	}{{
+		name: "no dependencies",
+		want: "600s",
+	}, {
+		// Coord enforces the timeout once the dependencies are done.
+		name:   "dependencies",
+		params: []config.Param{{Name: "build"}},
+		want:   "86400s",
+	}, {
+		name:   "dependencies and workflow timeout",
+		params: []config.Param{{Name: "build"}},
+		opts:   Options{Timeout: time.Hour},
+		want:   "4200s",
+	}, {
+		name:      "completed dependencies",
+		params:    []config.Param{{Name: "build"}},
+		completed: map[string]bool{"build": true},
+		want:      "600s",
+	}} {
+		build := &v1cloudbuild.Build{}
+		execution := config.Execution{Name: "test", Params: tc.params, Timeout: 10 * time.Minute}
+		AugmentBuild(build, "gs://bucket/workflow", "workflow", "subscription", execution, tc.opts, 1, tc.completed)
+		if build.Timeout != tc.want {
+			t.Errorf("%s: got timeout %s, want %s", tc.name, build.Timeout, tc.want)
+		}
+	}
+}
+
+func TestDerive(t *testing.T) {
+	s := NewState()
+	s.Apply(Message{
+		Config: &config.Config{
+			Executions: []config.Execution{
+				{Name: "build"},
+				{Name: "test", Params: []config.Param{{Name: "build"}}},
+			},
+		},
+		Options: &Options{UpstreamFailure: UpstreamFailureFail},
+	})
+
+	// derive applies and returns whatever the state derives, as coord would.
+	derive := func() []Message {
+		msgs := s.Derive()
+		for _, m := range msgs {
+			s.Apply(m)
+		}
+		return msgs
+	}
+
+	if got, want := derive(), []Message{{Unblocked: "build"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	s.Apply(Message{Started: "build", Build: "b1", Attempt: 1})
+	s.Apply(Message{Failed: "build", Build: "b1", Attempt: 1})
+	if got, want := derive(), []Message{{Result: StatusFailed}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if !s.Over() {
+		t.Errorf("a failed workflow is not over under %s", UpstreamFailureFail)
+	}
+
+	// Under park, a retry gets the workflow going again.
+	s.Options.UpstreamFailure = UpstreamFailurePark
+	if s.Over() {
+		t.Errorf("a failed workflow is over under %s", UpstreamFailurePark)
+	}
+	s.Apply(Message{Started: "build", Build: "b2", Attempt: 2})
+	if s.Result != "" {
+		t.Errorf("got result %s after a retry", s.Result)
+	}
+	s.Apply(Message{Completed: "build", Build: "b2", Attempt: 2})
+	if got, want := derive(), []Message{{Unblocked: "test"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	s.Apply(Message{Completed: "test"})
+	if got, want := derive(), []Message{{Result: StatusSucceeded}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got := derive(); len(got) != 0 {
+		t.Errorf("got %+v again", got)
+	}
+}